@@ -1,50 +1,144 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/ignimbrite/bsmart-challenge/internal/config"
 	appdb "github.com/ignimbrite/bsmart-challenge/internal/db"
-	"github.com/ignimbrite/bsmart-challenge/internal/models"
+	"github.com/ignimbrite/bsmart-challenge/internal/eventbus"
+	"github.com/ignimbrite/bsmart-challenge/internal/logging"
+	"github.com/ignimbrite/bsmart-challenge/internal/mailer"
 	"github.com/ignimbrite/bsmart-challenge/internal/seed"
 	"github.com/ignimbrite/bsmart-challenge/internal/server"
+	"github.com/ignimbrite/bsmart-challenge/internal/tracing"
 )
 
 func main() {
 	cfg := config.Load()
 
+	logger, err := logging.New(os.Stdout, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fatal("invalid log settings", err)
+	}
+	slog.SetDefault(logger)
+
+	if len(os.Args) > 1 {
+		if os.Args[1] != "migrate" {
+			fatal("unknown command", fmt.Errorf("%q (usage: server [migrate <command>])", os.Args[1]))
+		}
+		if err := runMigrate(cfg, os.Args[2:]); err != nil {
+			fatal("migrate failed", err)
+		}
+		return
+	}
+
+	flushTraces, err := tracing.Setup(cfg)
+	if err != nil {
+		fatal("invalid tracing settings", err)
+	}
+
 	db, err := appdb.Connect(cfg)
 	if err != nil {
-		log.Fatalf("failed to connect database: %v", err)
+		fatal("failed to connect database", err)
 	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
-		log.Fatalf("failed to get sql DB: %v", err)
+		fatal("failed to get sql DB", err)
 	}
 	defer sqlDB.Close()
 
-	if err := models.AutoMigrate(db); err != nil {
-		log.Fatalf("auto migrate failed: %v", err)
+	migrator, err := newMigrator(db)
+	if err != nil {
+		fatal("invalid migrations", err)
+	}
+	if cfg.MigrateOnStart {
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			fatal("migrations failed", err)
+		}
+		for _, migration := range applied {
+			slog.Info("migration applied", "version", migration.Version, "name", migration.Name)
+		}
+	} else if pending, err := migrator.Pending(context.Background()); err != nil {
+		fatal("failed to read migration status", err)
+	} else if pending > 0 {
+		fatal("database schema is behind", fmt.Errorf("%d pending migrations; run `server migrate up`", pending))
+	}
+
+	if err := seed.Roles(db); err != nil {
+		fatal("seed roles failed", err)
 	}
 
 	if cfg.AppEnv == "development" || cfg.SeedOnStart {
 		if err := seed.Run(db); err != nil {
-			log.Fatalf("seed failed: %v", err)
+			fatal("seed failed", err)
 		}
 	}
 
 	tokenTTL, err := time.ParseDuration(cfg.JWTExpiration)
 	if err != nil {
-		log.Fatalf("invalid JWT_EXPIRATION: %v", err)
+		fatal("invalid JWT_EXPIRATION", err)
+	}
+
+	refreshTTL, err := time.ParseDuration(cfg.RefreshTTL)
+	if err != nil {
+		fatal("invalid REFRESH_TOKEN_EXPIRATION", err)
+	}
+
+	keys, err := server.LoadKeySet(cfg)
+	if err != nil {
+		fatal("invalid JWT keys", err)
+	}
+
+	mail, err := mailer.New(cfg)
+	if err != nil {
+		fatal("invalid mail settings", err)
+	}
+
+	bus, err := eventbus.New(cfg, db)
+	if err != nil {
+		fatal("invalid event bus settings", err)
 	}
 
-	srv := server.New(cfg, db, []byte(cfg.JWTSecret), tokenTTL)
+	srv := server.New(cfg, db, keys, mail, bus, tokenTTL, refreshTTL)
+
+	slog.Info("starting api server", "port", cfg.HTTPPort, "env", cfg.AppEnv)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	log.Printf("starting api server on :%s (env: %s)", cfg.HTTPPort, cfg.AppEnv)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Run() }()
 
-	if err := srv.Run(); err != nil {
-		log.Fatalf("server error: %v", err)
+	select {
+	case err := <-errs:
+		if err != nil {
+			fatal("server error", err)
+		}
+	case <-ctx.Done():
 	}
+	stop()
+
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown incomplete", "error", err)
+	}
+	if err := flushTraces(shutdownCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/config"
+	appdb "github.com/ignimbrite/bsmart-challenge/internal/db"
+	"github.com/ignimbrite/bsmart-challenge/internal/migrate"
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+	"github.com/ignimbrite/bsmart-challenge/migrations"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+  up                apply every pending migration
+  down [n|all]      revert the last n applied migrations (default 1)
+  status            list migrations and when they were applied
+  create [-dir d] <name>
+                    write empty up/down files for a new migration in d
+                    (default ./migrations)`
+
+func newMigrator(db *gorm.DB) (*migrate.Migrator, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	m, err := migrate.New(sqlDB, migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+	m.Adopt = func(ctx context.Context) error {
+		return models.AutoMigrate(db.WithContext(ctx))
+	}
+	return m, nil
+}
+
+// runMigrate is the `migrate` subcommand.
+func runMigrate(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	if args[0] == "create" {
+		flags := flag.NewFlagSet("create", flag.ContinueOnError)
+		dir := flags.String("dir", "migrations", "directory of the migration files")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New(migrateUsage)
+		}
+		up, down, err := migrate.Create(*dir, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %s\ncreated %s\n", up, down)
+		return nil
+	}
+
+	db, err := appdb.Connect(cfg)
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	m, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if args[1] == "all" {
+				steps = int(^uint(0) >> 1)
+			} else if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return errors.New(migrateUsage)
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Println("no applied migrations")
+		}
+		return err
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			switch {
+			case status.Missing:
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05") + " (not in this binary)"
+			case status.AppliedAt != nil:
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+	}
+	return errors.New(migrateUsage)
+}
@@ -5,27 +5,131 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	AppEnv        string
-	HTTPPort      string
-	DatabaseURL   string
-	JWTSecret     string
-	JWTExpiration string
-	WSAllowed     []string
-	SeedOnStart   bool
+	AppEnv              string
+	HTTPPort            string
+	ShutdownTimeout     time.Duration
+	LogLevel            string
+	LogFormat           string
+	ServiceName         string
+	TracesExporter      string
+	TracesSampleRatio   float64
+	DatabaseURL         string
+	JWTSecret           string
+	JWTExpiration       string
+	JWTIssuer           string
+	JWTSigningKeyFile   string
+	JWTVerifyKeyFiles   []string
+	RefreshTTL          string
+	WSAllowed           []string
+	WSSendBuffer        int
+	WSBackpressure      string
+	SeedOnStart         bool
+	MigrateOnStart      bool
+	LowStockThreshold   int
+	EventRetention      time.Duration
+	EventBus            string
+	OutboxRetention     time.Duration
+	WebhookTimeout      time.Duration
+	WebhookMaxAttempts  int
+	WebhookAllowPrivate bool
+	MetricsToken        string
+	MetricsAllowedIPs   []string
+	TrustedProxies      []string
+
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	LoginBackoffBase time.Duration
+	LoginBackoffMax  time.Duration
+
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCGroupsClaim  string
+	OIDCRoleMappings []RoleMapping
+	OIDCDefaultRole  string
+	OIDCOrganization string
+
+	MailDriver           string
+	MailFrom             string
+	MailDir              string
+	MailLinkBaseURL      string
+	SMTPHost             string
+	SMTPPort             string
+	SMTPUsername         string
+	SMTPPassword         string
+	PasswordResetTTL     time.Duration
+	EmailVerificationTTL time.Duration
+}
+
+type RoleMapping struct {
+	Group string
+	Role  string
 }
 
 func Load() Config {
 	return Config{
-		AppEnv:        getEnv("APP_ENV", "development"),
-		HTTPPort:      getEnv("HTTP_PORT", "8080"),
-		DatabaseURL:   getEnv("DATABASE_URL", buildDatabaseURL()),
-		JWTSecret:     getEnv("JWT_SECRET", "dev-secret"),
-		JWTExpiration: getEnv("JWT_EXPIRATION", "1h"),
-		WSAllowed:     parseCSV(getEnv("WS_ALLOWED_ORIGINS", "http://localhost,http://127.0.0.1,http://localhost:8080,http://127.0.0.1:8080,https://ignimbrite.github.io,https://8113c6fc74a6.ngrok-free.app")),
-		SeedOnStart:   getEnvAsBool("SEED_ON_START", false),
+		AppEnv:              getEnv("APP_ENV", "development"),
+		HTTPPort:            getEnv("HTTP_PORT", "8080"),
+		ShutdownTimeout:     getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		LogLevel:            getEnv("LOG_LEVEL", "info"),
+		LogFormat:           getEnv("LOG_FORMAT", "json"),
+		ServiceName:         getEnv("OTEL_SERVICE_NAME", "bsmart-api"),
+		TracesExporter:      getEnv("OTEL_TRACES_EXPORTER", "none"),
+		TracesSampleRatio:   getEnvAsFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+		DatabaseURL:         getEnv("DATABASE_URL", buildDatabaseURL()),
+		JWTSecret:           getEnv("JWT_SECRET", "dev-secret"),
+		JWTExpiration:       getEnv("JWT_EXPIRATION", "1h"),
+		JWTIssuer:           getEnv("JWT_ISSUER", "bsmart"),
+		JWTSigningKeyFile:   getEnv("JWT_SIGNING_KEY_FILE", ""),
+		JWTVerifyKeyFiles:   parseCSV(getEnv("JWT_VERIFY_KEY_FILES", "")),
+		RefreshTTL:          getEnv("REFRESH_TOKEN_EXPIRATION", "720h"),
+		WSAllowed:           parseCSV(getEnv("WS_ALLOWED_ORIGINS", "http://localhost,http://127.0.0.1,http://localhost:8080,http://127.0.0.1:8080,https://ignimbrite.github.io,https://8113c6fc74a6.ngrok-free.app")),
+		WSSendBuffer:        getEnvAsInt("WS_SEND_BUFFER", 64),
+		WSBackpressure:      getEnv("WS_BACKPRESSURE", "drop_oldest"),
+		SeedOnStart:         getEnvAsBool("SEED_ON_START", false),
+		MigrateOnStart:      getEnvAsBool("MIGRATE_ON_START", true),
+		LowStockThreshold:   getEnvAsInt("LOW_STOCK_THRESHOLD", 5),
+		EventRetention:      getEnvAsDuration("EVENT_RETENTION", 24*time.Hour),
+		EventBus:            getEnv("EVENT_BUS", "memory"),
+		OutboxRetention:     getEnvAsDuration("OUTBOX_RETENTION", 30*24*time.Hour),
+		WebhookTimeout:      getEnvAsDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts:  getEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookAllowPrivate: getEnvAsBool("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false),
+		MetricsToken:        getEnv("METRICS_TOKEN", ""),
+		MetricsAllowedIPs:   parseCSV(getEnv("METRICS_ALLOWED_IPS", "")),
+		TrustedProxies:      parseCSV(getEnv("TRUSTED_PROXIES", "")),
+
+		LoginMaxFailures: getEnvAsInt("LOGIN_MAX_FAILURES", 5),
+		LoginLockout:     getEnvAsDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		LoginBackoffBase: getEnvAsDuration("LOGIN_BACKOFF_BASE", time.Second),
+		LoginBackoffMax:  getEnvAsDuration("LOGIN_BACKOFF_MAX", 5*time.Minute),
+
+		OIDCIssuerURL:    getEnv("OIDC_ISSUER_URL", ""),
+		OIDCClientID:     getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:  getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/api/auth/oidc/callback"),
+		OIDCScopes:       parseCSV(getEnv("OIDC_SCOPES", "openid,email,profile")),
+		OIDCGroupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		OIDCRoleMappings: parseRoleMappings(getEnv("OIDC_ROLE_MAPPING", "")),
+		OIDCDefaultRole:  getEnv("OIDC_DEFAULT_ROLE", ""),
+		OIDCOrganization: getEnv("OIDC_ORGANIZATION", "default"),
+
+		MailDriver:           getEnv("MAIL_DRIVER", "log"),
+		MailFrom:             getEnv("MAIL_FROM", "bsmart <no-reply@bsmart.test>"),
+		MailDir:              getEnv("MAIL_DIR", "tmp/mail"),
+		MailLinkBaseURL:      strings.TrimRight(getEnv("MAIL_LINK_BASE_URL", "http://localhost:8080/web"), "/"),
+		SMTPHost:             getEnv("SMTP_HOST", ""),
+		SMTPPort:             getEnv("SMTP_PORT", "587"),
+		SMTPUsername:         getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:         getEnv("SMTP_PASSWORD", ""),
+		PasswordResetTTL:     getEnvAsDuration("PASSWORD_RESET_EXPIRATION", time.Hour),
+		EmailVerificationTTL: getEnvAsDuration("EMAIL_VERIFICATION_EXPIRATION", 48*time.Hour),
 	}
 }
 
@@ -57,6 +161,20 @@ func parseCSV(value string) []string {
 	return items
 }
 
+// parseRoleMappings reads "group=role" pairs; order is kept so the first
+// matching group wins.
+func parseRoleMappings(value string) []RoleMapping {
+	var mappings []RoleMapping
+	for _, item := range parseCSV(value) {
+		group, role, ok := strings.Cut(item, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if ok && group != "" && role != "" {
+			mappings = append(mappings, RoleMapping{Group: group, Role: role})
+		}
+	}
+	return mappings
+}
+
 func getEnvAsBool(key string, fallback bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := strconv.ParseBool(value); err == nil {
@@ -65,3 +183,30 @@ func getEnvAsBool(key string, fallback bool) bool {
 	}
 	return fallback
 }
+
+func getEnvAsInt(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvAsFloat(key string, fallback float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
+func getEnvAsDuration(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
@@ -1,19 +1,21 @@
 package db
 
 import (
-	"log"
+	"log/slog"
 	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
+	otelgorm "gorm.io/plugin/opentelemetry/tracing"
 
 	"github.com/ignimbrite/bsmart-challenge/internal/config"
+	"github.com/ignimbrite/bsmart-challenge/internal/logging"
 )
 
 func Connect(cfg config.Config) (*gorm.DB, error) {
 	gormConfig := &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Warn),
+		Logger:         logging.GormLogger{},
+		TranslateError: true,
 	}
 
 	conn, err := gorm.Open(postgres.Open(cfg.DatabaseURL), gormConfig)
@@ -21,6 +23,12 @@ func Connect(cfg config.Config) (*gorm.DB, error) {
 		return nil, err
 	}
 
+	// One span per statement, child of the request's span when the query
+	// runs WithContext. Bound values are left out of the spans.
+	if err := conn.Use(otelgorm.NewPlugin(otelgorm.WithoutMetrics(), otelgorm.WithoutQueryVariables())); err != nil {
+		return nil, err
+	}
+
 	sqlDB, err := conn.DB()
 	if err != nil {
 		return nil, err
@@ -32,7 +40,7 @@ func Connect(cfg config.Config) (*gorm.DB, error) {
 	sqlDB.SetConnMaxLifetime(60 * time.Minute)
 
 	if err := sqlDB.Ping(); err != nil {
-		log.Printf("warn: database ping failed: %v", err)
+		slog.Warn("database ping failed", "error", err)
 	}
 
 	return conn, nil
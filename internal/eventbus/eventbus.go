@@ -0,0 +1,61 @@
+package eventbus
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/config"
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+// Bus fans events already stored in the event log out to every API instance,
+// the publishing one included. Each instance's handler sees every event once,
+// in sequence order.
+type Bus interface {
+	Publish(ctx context.Context, event models.Event) error
+	// Run delivers events to handler until ctx is done.
+	Run(ctx context.Context, handler func(models.Event)) error
+}
+
+// New picks the implementation from EVENT_BUS: "memory" or "postgres".
+func New(cfg config.Config, db *gorm.DB) (Bus, error) {
+	switch cfg.EventBus {
+	case "postgres":
+		return NewPostgres(cfg.DatabaseURL, db), nil
+	case "memory", "":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown EVENT_BUS %q", cfg.EventBus)
+	}
+}
+
+// Memory only reaches the current process; enough for a single replica.
+type Memory struct {
+	events chan models.Event
+}
+
+func NewMemory() *Memory {
+	return &Memory{events: make(chan models.Event, 256)}
+}
+
+func (m *Memory) Publish(ctx context.Context, event models.Event) error {
+	select {
+	case m.events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Memory) Run(ctx context.Context, handler func(models.Event)) error {
+	for {
+		select {
+		case event := <-m.events:
+			handler(event)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
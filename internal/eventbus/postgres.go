@@ -0,0 +1,115 @@
+package eventbus
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	pgChannel    = "bsmart_events"
+	pgPageSize   = 500
+	pgRetryFirst = time.Second
+	pgRetryMax   = 30 * time.Second
+)
+
+// Postgres uses LISTEN/NOTIFY as a wake-up signal only: the notification
+// carries the sequence number and every instance reads the events after the
+// last one it delivered from the log. Events are committed in sequence order,
+// so this delivers each one exactly once per instance and a missed
+// notification is caught up by the next one.
+type Postgres struct {
+	dsn    string
+	db     *gorm.DB
+	last   uint64
+	seeded bool
+}
+
+func NewPostgres(dsn string, db *gorm.DB) *Postgres {
+	return &Postgres{dsn: dsn, db: db}
+}
+
+func (p *Postgres) Publish(ctx context.Context, event models.Event) error {
+	return p.db.WithContext(ctx).
+		Exec("SELECT pg_notify(?, ?)", pgChannel, strconv.FormatUint(event.Seq, 10)).Error
+}
+
+// Run only returns once ctx is done; every failure, including the first
+// connection, is retried with backoff.
+func (p *Postgres) Run(ctx context.Context, handler func(models.Event)) error {
+	retry := pgRetryFirst
+	for {
+		err := p.listen(ctx, handler, func() { retry = pgRetryFirst })
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Warn("event bus listener failed, reconnecting", "error", err, "retry_in", retry.String())
+
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if retry *= 2; retry > pgRetryMax {
+			retry = pgRetryMax
+		}
+	}
+}
+
+func (p *Postgres) listen(ctx context.Context, handler func(models.Event), connected func()) error {
+	conn, err := pgx.Connect(ctx, p.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgChannel); err != nil {
+		return err
+	}
+	// Start at the head of the log; older events are served by ?since= replay.
+	if !p.seeded {
+		if err := p.db.WithContext(ctx).Model(&models.Event{}).
+			Select("COALESCE(MAX(seq), 0)").Scan(&p.last).Error; err != nil {
+			return err
+		}
+		p.seeded = true
+	}
+	connected()
+
+	// Catch up on whatever was published while not listening.
+	for {
+		if err := p.drain(ctx, handler); err != nil {
+			return err
+		}
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Postgres) drain(ctx context.Context, handler func(models.Event)) error {
+	for {
+		var events []models.Event
+		if err := p.db.WithContext(ctx).
+			Where("seq > ?", p.last).
+			Order("seq asc").
+			Limit(pgPageSize).
+			Find(&events).Error; err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			handler(event)
+			p.last = event.Seq
+		}
+		if len(events) < pgPageSize {
+			return nil
+		}
+	}
+}
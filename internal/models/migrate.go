@@ -0,0 +1,93 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+const DefaultOrganizationSlug = "default"
+
+// tenantTables gained organization_id after they already held data; rows
+// from before that belong to the default organization.
+var tenantTables = []string{"products", "categories", "api_keys", "refresh_tokens"}
+
+// AutoMigrate is how the schema was managed before versioned migrations. It
+// only runs now to bring a database it created up to migration 0001, when
+// the migrator adopts it.
+func AutoMigrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Organization{}, &Membership{}); err != nil {
+		return err
+	}
+
+	org, created, err := ensureDefaultOrganization(db)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tenantTables {
+		if err := backfillOrganization(db, table, org.ID); err != nil {
+			return fmt.Errorf("backfill %s: %w", table, err)
+		}
+	}
+
+	// Category names used to be unique across the whole catalog.
+	if db.Migrator().HasIndex(&Category{}, "idx_categories_name") {
+		if err := db.Migrator().DropIndex(&Category{}, "idx_categories_name"); err != nil {
+			return err
+		}
+	}
+
+	if err := db.AutoMigrate(&Category{}, &Product{}, &ProductCategory{}, &ProductHistory{}, &User{}, &Role{}, &Permission{}, &RolePermission{}, &APIKey{}, &APIKeyPermission{}, &RecoveryCode{}, &RefreshToken{}, &Session{}, &UserToken{}, &WSTicket{}, &Event{}, &OutboxEvent{}, &Webhook{}, &WebhookDelivery{}); err != nil {
+		return err
+	}
+
+	if created {
+		return db.Exec(
+			"INSERT INTO memberships (organization_id, user_id, created_at) SELECT ?, id, NOW() FROM users ON CONFLICT DO NOTHING",
+			org.ID,
+		).Error
+	}
+	return nil
+}
+
+func DefaultOrganization(db *gorm.DB) (*Organization, error) {
+	var org Organization
+	if err := db.Where("slug = ?", DefaultOrganizationSlug).First(&org).Error; err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+func ensureDefaultOrganization(db *gorm.DB) (*Organization, bool, error) {
+	org, err := DefaultOrganization(db)
+	if err == nil {
+		return org, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	org = &Organization{Name: "Default", Slug: DefaultOrganizationSlug}
+	if err := db.Create(org).Error; err != nil {
+		return nil, false, err
+	}
+	return org, true, nil
+}
+
+func backfillOrganization(db *gorm.DB, table string, orgID uint) error {
+	if !db.Migrator().HasTable(table) || db.Migrator().HasColumn(table, "organization_id") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN organization_id bigint", table)).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf("UPDATE %s SET organization_id = ?", table), orgID).Error; err != nil {
+			return err
+		}
+		return tx.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN organization_id SET NOT NULL", table)).Error
+	})
+}
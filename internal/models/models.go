@@ -3,24 +3,26 @@ package models
 import "time"
 
 type Product struct {
-	ID          uint       `gorm:"primaryKey"`
-	Name        string     `gorm:"size:255;not null;index:idx_products_name,sort:asc"`
-	Description string     `gorm:"type:text"`
-	Price       float64    `gorm:"type:numeric(12,2);not null"`
-	Stock       int        `gorm:"not null;default:0;index"`
-	Categories  []Category `gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
-	History     []ProductHistory `gorm:"constraint:OnDelete:CASCADE"`
-	CreatedAt   time.Time `gorm:"index"`
-	UpdatedAt   time.Time
+	ID             uint             `gorm:"primaryKey"`
+	OrganizationID uint             `gorm:"not null;index"`
+	Name           string           `gorm:"size:255;not null;index:idx_products_name,sort:asc"`
+	Description    string           `gorm:"type:text"`
+	Price          float64          `gorm:"type:numeric(12,2);not null"`
+	Stock          int              `gorm:"not null;default:0;index"`
+	Categories     []Category       `gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
+	History        []ProductHistory `gorm:"constraint:OnDelete:CASCADE"`
+	CreatedAt      time.Time        `gorm:"index"`
+	UpdatedAt      time.Time
 }
 
 type Category struct {
-	ID          uint      `gorm:"primaryKey"`
-	Name        string    `gorm:"size:255;not null;uniqueIndex"`
-	Description string    `gorm:"type:text"`
-	Products    []Product `gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
-	CreatedAt   time.Time `gorm:"index"`
-	UpdatedAt   time.Time
+	ID             uint      `gorm:"primaryKey"`
+	OrganizationID uint      `gorm:"not null;uniqueIndex:idx_categories_org_name,priority:1"`
+	Name           string    `gorm:"size:255;not null;uniqueIndex:idx_categories_org_name,priority:2"`
+	Description    string    `gorm:"type:text"`
+	Products       []Product `gorm:"many2many:product_categories;constraint:OnDelete:CASCADE"`
+	CreatedAt      time.Time `gorm:"index"`
+	UpdatedAt      time.Time
 }
 
 type ProductCategory struct {
@@ -36,19 +38,211 @@ type ProductHistory struct {
 	ChangedAt time.Time `gorm:"autoCreateTime"`
 }
 
+// Organization is a tenant: it owns its own catalog (products, categories)
+// and only its members can act on it.
+type Organization struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"size:255;not null"`
+	Slug      string `gorm:"size:100;not null;uniqueIndex"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type Membership struct {
+	OrganizationID uint `gorm:"primaryKey"`
+	UserID         uint `gorm:"primaryKey;index"`
+	CreatedAt      time.Time
+}
+
 type User struct {
-	ID           uint   `gorm:"primaryKey"`
-	Email        string `gorm:"size:255;uniqueIndex;not null"`
-	PasswordHash string `gorm:"not null"`
-	Role         string `gorm:"size:50;not null;index"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID              uint       `gorm:"primaryKey"`
+	Email           string     `gorm:"size:255;uniqueIndex;not null"`
+	PasswordHash    string     `gorm:"not null" json:"-"`
+	Role            string     `gorm:"size:50;not null;index"`
+	DisabledAt      *time.Time `gorm:"index"`
+	FailedLogins    int        `gorm:"not null;default:0"`
+	LockedUntil     *time.Time
+	TOTPSecret      string `gorm:"size:64" json:"-"`
+	TOTPEnabledAt   *time.Time
+	TOTPLastStep    int64   `gorm:"not null;default:0" json:"-"`
+	OIDCSubject     *string `gorm:"size:255;uniqueIndex"`
+	EmailVerifiedAt *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+type Role struct {
+	ID          uint   `gorm:"primaryKey"`
+	Name        string `gorm:"size:50;not null;uniqueIndex"`
+	Description string `gorm:"type:text"`
+	System      bool   `gorm:"not null;default:false"`
+	RequireMFA  bool   `gorm:"not null;default:false"`
+	// OrganizationID is the organization a custom role belongs to; nil for
+	// roles shared by all of them.
+	OrganizationID *uint        `gorm:"index"`
+	Permissions    []Permission `gorm:"many2many:role_permissions;constraint:OnDelete:CASCADE"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type Permission struct {
+	ID          uint   `gorm:"primaryKey"`
+	Name        string `gorm:"size:100;not null;uniqueIndex"`
+	Description string `gorm:"type:text"`
+}
+
+type RolePermission struct {
+	RoleID       uint `gorm:"primaryKey"`
+	PermissionID uint `gorm:"primaryKey"`
+}
+
+type APIKey struct {
+	ID             uint         `gorm:"primaryKey"`
+	OrganizationID uint         `gorm:"not null;index"`
+	Name           string       `gorm:"size:255;not null"`
+	Prefix         string       `gorm:"size:16;not null"`
+	KeyHash        string       `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Scopes         []Permission `gorm:"many2many:api_key_permissions;constraint:OnDelete:CASCADE"`
+	CreatedByID    uint         `gorm:"not null;index"`
+	ExpiresAt      time.Time    `gorm:"not null"`
+	LastUsedAt     *time.Time
+	RevokedAt      *time.Time `gorm:"index"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type APIKeyPermission struct {
+	APIKeyID     uint `gorm:"primaryKey"`
+	PermissionID uint `gorm:"primaryKey"`
+}
+
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"size:64;not null;uniqueIndex"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Session is one login. Its ID is the sid claim of access tokens and the
+// family of its refresh tokens; revoking it ends both.
+type Session struct {
+	ID             string     `gorm:"primaryKey;size:32"`
+	UserID         uint       `gorm:"not null;index"`
+	OrganizationID uint       `gorm:"not null"`
+	UserAgent      string     `gorm:"size:255"`
+	IP             string     `gorm:"size:64"`
+	ExpiresAt      time.Time  `gorm:"not null"`
+	LastSeenAt     time.Time  `gorm:"not null"`
+	RevokedAt      *time.Time `gorm:"index"`
+	CreatedAt      time.Time
+}
+
+// Event is an entry of the real-time event log. Seq orders every event and
+// lets WebSocket clients resume where they left off.
+type Event struct {
+	Seq            uint64    `gorm:"primaryKey;autoIncrement;index:idx_events_org_seq,priority:2"`
+	OrganizationID uint      `gorm:"not null;index:idx_events_org_seq,priority:1"`
+	Type           string    `gorm:"size:64;not null"`
+	Topics         string    `gorm:"size:255;not null"`
+	Payload        []byte    `gorm:"type:jsonb;not null"`
+	RequestID      string    `gorm:"size:128"`
+	TraceParent    string    `gorm:"size:64"`
+	CreatedAt      time.Time `gorm:"not null;index"`
+}
+
+// OutboxEvent is written in the same transaction as the change it reports.
+// The dispatcher later copies it into the event log, which assigns its
+// sequence number, and keeps the row as a record of what was published.
+type OutboxEvent struct {
+	ID             uint       `gorm:"primaryKey"`
+	OrganizationID uint       `gorm:"not null"`
+	Type           string     `gorm:"size:64;not null"`
+	Topics         string     `gorm:"size:255;not null"`
+	Payload        []byte     `gorm:"type:jsonb;not null"`
+	RequestID      string     `gorm:"size:128"`
+	TraceParent    string     `gorm:"size:64"`
+	EventSeq       *uint64    `gorm:"index"`
+	DispatchedAt   *time.Time `gorm:"index:idx_outbox_events_pending,where:dispatched_at IS NULL"`
+	CreatedAt      time.Time  `gorm:"not null;index"`
 }
 
-func AutoMigrate(db GormMigrator) error {
-	return db.AutoMigrate(&Category{}, &Product{}, &ProductCategory{}, &ProductHistory{}, &User{})
+// Webhook posts the events it lists to an external URL, signed with Secret.
+type Webhook struct {
+	ID             uint              `gorm:"primaryKey"`
+	OrganizationID uint              `gorm:"not null;index"`
+	URL            string            `gorm:"size:2048;not null"`
+	Events         StringList        `gorm:"size:1024;not null"`
+	Secret         string            `gorm:"size:128;not null" json:"-"`
+	Active         bool              `gorm:"not null"`
+	Deliveries     []WebhookDelivery `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	CreatedByID    uint              `gorm:"not null"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
 }
 
-type GormMigrator interface {
-	AutoMigrate(dst ...interface{}) error
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is both the retry queue and the delivery log: pending rows
+// are picked up once NextAttemptAt is due.
+type WebhookDelivery struct {
+	ID             uint      `gorm:"primaryKey"`
+	WebhookID      uint      `gorm:"not null;index"`
+	OrganizationID uint      `gorm:"not null"`
+	EventSeq       uint64    `gorm:"not null"`
+	Event          string    `gorm:"size:64;not null"`
+	Payload        []byte    `gorm:"type:jsonb;not null" json:"-"`
+	Status         string    `gorm:"size:16;not null;index:idx_webhook_deliveries_due,priority:1"`
+	Attempts       int       `gorm:"not null;default:0"`
+	NextAttemptAt  time.Time `gorm:"not null;index:idx_webhook_deliveries_due,priority:2"`
+	LastAttemptAt  *time.Time
+	DeliveredAt    *time.Time
+	ResponseStatus int
+	LastError      string `gorm:"type:text"`
+	// ReplayOfID points at the delivery this one was replayed from.
+	ReplayOfID *uint
+	CreatedAt  time.Time `gorm:"index"`
+	UpdatedAt  time.Time
+}
+
+// WSTicket is a single-use credential for opening /ws, so the JWT never has
+// to travel in a query string. It mirrors the caller's auth at issue time.
+type WSTicket struct {
+	TokenHash      string `gorm:"primaryKey;size:64"`
+	UserID         uint
+	APIKeyID       uint
+	OrganizationID uint   `gorm:"not null"`
+	SessionID      string `gorm:"size:32"`
+	Role           string `gorm:"size:50"`
+	AuthExpiresAt  time.Time
+	ExpiresAt      time.Time `gorm:"not null;index"`
+	CreatedAt      time.Time
+}
+
+type RefreshToken struct {
+	ID             uint       `gorm:"primaryKey"`
+	UserID         uint       `gorm:"not null;index"`
+	OrganizationID uint       `gorm:"not null"`
+	FamilyID       string     `gorm:"size:64;not null;index"`
+	TokenHash      string     `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt      time.Time  `gorm:"not null;index"`
+	RevokedAt      *time.Time `gorm:"index"`
+	ReplacedByID   *uint
+	CreatedAt      time.Time
+}
+
+// UserToken backs single-use links sent by email (password reset, email
+// verification); only the hash of the token is stored.
+type UserToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	Purpose   string    `gorm:"size:32;not null;index"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
 }
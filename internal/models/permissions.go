@@ -0,0 +1,71 @@
+package models
+
+const (
+	// RolePlatform manages every organization; RoleAdmin has every other
+	// permission within one.
+	RolePlatform = "platform"
+	RoleAdmin    = "admin"
+	RoleClient   = "client"
+)
+
+const (
+	PermProductsRead     = "products:read"
+	PermProductsWrite    = "products:write"
+	PermProductsStock    = "products:stock"
+	PermProductsDelete   = "products:delete"
+	PermCategoriesRead   = "categories:read"
+	PermCategoriesWrite  = "categories:write"
+	PermCategoriesDelete = "categories:delete"
+	PermHistoryRead      = "history:read"
+	PermUsersManage      = "users:manage"
+	PermRolesManage      = "roles:manage"
+	PermAPIKeysManage    = "apikeys:manage"
+	PermOrgsManage       = "organizations:manage"
+	PermWSSubscribe      = "ws:subscribe"
+	PermWebhooksManage   = "webhooks:manage"
+	PermPlatformManage   = "platform:manage"
+)
+
+var PermissionDescriptions = map[string]string{
+	PermProductsRead:     "List and view products",
+	PermProductsWrite:    "Create products and change any product field",
+	PermProductsStock:    "Change product stock only",
+	PermProductsDelete:   "Delete products",
+	PermCategoriesRead:   "List and view categories",
+	PermCategoriesWrite:  "Create and update categories",
+	PermCategoriesDelete: "Delete categories",
+	PermHistoryRead:      "View product price/stock history",
+	PermUsersManage:      "Manage users",
+	PermRolesManage:      "Manage roles and their permissions",
+	PermAPIKeysManage:    "Manage API keys for integrations",
+	PermOrgsManage:       "Manage organizations and their members",
+	PermWSSubscribe:      "Subscribe to real-time events",
+	PermWebhooksManage:   "Manage outbound webhooks and their deliveries",
+	PermPlatformManage:   "Manage users and organizations across all organizations",
+}
+
+var ClientPermissions = []string{
+	PermProductsRead,
+	PermCategoriesRead,
+	PermHistoryRead,
+	PermWSSubscribe,
+}
+
+// AdminPermissions is every permission except platform:manage.
+func AdminPermissions() []string {
+	perms := make([]string, 0, len(PermissionDescriptions))
+	for name := range PermissionDescriptions {
+		if name != PermPlatformManage {
+			perms = append(perms, name)
+		}
+	}
+	return perms
+}
+
+func AllPermissions() []string {
+	perms := make([]string, 0, len(PermissionDescriptions))
+	for name := range PermissionDescriptions {
+		perms = append(perms, name)
+	}
+	return perms
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// StringList is stored as a comma-separated string and serialized as a JSON
+// array.
+type StringList []string
+
+func (StringList) GormDataType() string {
+	return "string"
+}
+
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	var raw string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", value)
+	}
+
+	*l = nil
+	if raw != "" {
+		*l = strings.Split(raw, ",")
+	}
+	return nil
+}
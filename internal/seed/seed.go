@@ -1,7 +1,8 @@
 package seed
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"math/rand"
 	"strings"
 	"time"
@@ -18,39 +19,44 @@ func Run(db *gorm.DB) error {
 	gofakeit.Seed(seed)
 	rand.Seed(seed)
 
+	org, err := models.DefaultOrganization(db)
+	if err != nil {
+		return err
+	}
+
 	var count int64
-	if err := db.Model(&models.Category{}).Count(&count).Error; err != nil {
+	if err := db.Model(&models.Category{}).Where("organization_id = ?", org.ID).Count(&count).Error; err != nil {
 		return err
 	}
 
 	if count > 0 {
-		log.Println("seed: categories already present, skipping categories/products")
+		slog.Info("seed: categories already present, skipping categories/products")
 	} else {
-		categories := buildCategories(10)
+		categories := buildCategories(org.ID, 10)
 		if err := db.Create(&categories).Error; err != nil {
 			return err
 		}
 
-		products := buildProducts(100, categories)
+		products := buildProducts(org.ID, 100, categories)
 		if err := db.Create(&products).Error; err != nil {
 			return err
 		}
 
-		log.Printf("seed: inserted %d categories and %d products", len(categories), len(products))
+		slog.Info("seed: inserted catalog", "categories", len(categories), "products", len(products))
 	}
 
-	if err := seedAdmin(db); err != nil {
+	if err := seedAdmin(db, org.ID); err != nil {
 		return err
 	}
 
-	if err := seedClient(db); err != nil {
+	if err := seedClient(db, org.ID); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func buildCategories(n int) []models.Category {
+func buildCategories(orgID uint, n int) []models.Category {
 	names := make(map[string]struct{})
 	var categories []models.Category
 
@@ -61,15 +67,16 @@ func buildCategories(n int) []models.Category {
 		}
 		names[name] = struct{}{}
 		categories = append(categories, models.Category{
-			Name:        name,
-			Description: fakeDescription(6, 8),
+			OrganizationID: orgID,
+			Name:           name,
+			Description:    fakeDescription(6, 8),
 		})
 	}
 
 	return categories
 }
 
-func buildProducts(n int, categories []models.Category) []models.Product {
+func buildProducts(orgID uint, n int, categories []models.Category) []models.Product {
 	var products []models.Product
 	names := make(map[string]struct{})
 
@@ -81,10 +88,11 @@ func buildProducts(n int, categories []models.Category) []models.Product {
 		names[name] = struct{}{}
 
 		product := models.Product{
-			Name:        name,
-			Description: fakeDescription(6, 12),
-			Price:       gofakeit.Price(5, 750),
-			Stock:       gofakeit.Number(0, 500),
+			OrganizationID: orgID,
+			Name:           name,
+			Description:    fakeDescription(6, 12),
+			Price:          gofakeit.Price(5, 750),
+			Stock:          gofakeit.Number(0, 500),
 		}
 
 		for _, idx := range randomCategoryIndexes(len(categories)) {
@@ -165,7 +173,7 @@ func randomCategory() string {
 	return gofakeit.RandomString(categories)
 }
 
-func seedAdmin(db *gorm.DB) error {
+func seedAdmin(db *gorm.DB, orgID uint) error {
 	const email = "admin@bsmart.test"
 	const password = "admin123"
 
@@ -179,21 +187,26 @@ func seedAdmin(db *gorm.DB) error {
 		return err
 	}
 
+	now := time.Now()
 	user := models.User{
-		Email:        email,
-		PasswordHash: string(hash),
-		Role:         "admin",
+		Email:           email,
+		PasswordHash:    string(hash),
+		Role:            models.RolePlatform,
+		EmailVerifiedAt: &now,
 	}
 
 	if err := db.Create(&user).Error; err != nil {
 		return err
 	}
+	if err := db.Create(&models.Membership{OrganizationID: orgID, UserID: user.ID}).Error; err != nil {
+		return err
+	}
 
-	log.Printf("seed: admin user created email=%s password=%s", email, password)
+	slog.Info("seed: admin user created", "email", email, "password", password)
 	return nil
 }
 
-func seedClient(db *gorm.DB) error {
+func seedClient(db *gorm.DB, orgID uint) error {
 	const email = "client@bsmart.test"
 	const password = "client123"
 
@@ -207,16 +220,84 @@ func seedClient(db *gorm.DB) error {
 		return err
 	}
 
+	now := time.Now()
 	user := models.User{
-		Email:        email,
-		PasswordHash: string(hash),
-		Role:         "client",
+		Email:           email,
+		PasswordHash:    string(hash),
+		Role:            models.RoleClient,
+		EmailVerifiedAt: &now,
 	}
 
 	if err := db.Create(&user).Error; err != nil {
 		return err
 	}
+	if err := db.Create(&models.Membership{OrganizationID: orgID, UserID: user.ID}).Error; err != nil {
+		return err
+	}
+
+	slog.Info("seed: client user created", "email", email, "password", password)
+	return nil
+}
+
+// Roles makes sure every known permission and the built-in platform, admin
+// and client roles exist. It runs on every boot, not only in development.
+func Roles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		byName := make(map[string]models.Permission)
+		for _, name := range models.AllPermissions() {
+			perm := models.Permission{Name: name, Description: models.PermissionDescriptions[name]}
+			if err := tx.Where(models.Permission{Name: name}).FirstOrCreate(&perm).Error; err != nil {
+				return err
+			}
+			byName[name] = perm
+		}
+
+		all := make([]models.Permission, 0, len(byName))
+		for _, perm := range byName {
+			all = append(all, perm)
+		}
+		if err := ensureRole(tx, models.RolePlatform, "Full access to every organization", all, true); err != nil {
+			return err
+		}
+
+		admin := make([]models.Permission, 0, len(byName))
+		for _, name := range models.AdminPermissions() {
+			admin = append(admin, byName[name])
+		}
+		if err := ensureRole(tx, models.RoleAdmin, "Full access to an organization", admin, true); err != nil {
+			return err
+		}
+
+		client := make([]models.Permission, 0, len(models.ClientPermissions))
+		for _, name := range models.ClientPermissions {
+			client = append(client, byName[name])
+		}
+		return ensureRole(tx, models.RoleClient, "Read-only access", client, false)
+	})
+}
+
+func ensureRole(db *gorm.DB, name, description string, perms []models.Permission, resync bool) error {
+	var role models.Role
+	err := db.Where("name = ?", name).First(&role).Error
+	if err == nil {
+		if !resync {
+			return nil
+		}
+		return db.Model(&role).Association("Permissions").Replace(perms)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
 
-	log.Printf("seed: client user created email=%s password=%s", email, password)
+	role = models.Role{
+		Name:        name,
+		Description: description,
+		System:      true,
+		Permissions: perms,
+	}
+	if err := db.Create(&role).Error; err != nil {
+		return err
+	}
+	slog.Info("seed: role created", "name", name, "permissions", len(perms))
 	return nil
 }
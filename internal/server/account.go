@@ -0,0 +1,339 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/mailer"
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	userTokenPasswordReset = "password_reset"
+	userTokenEmailVerify   = "email_verify"
+
+	// userTokenCooldown limits how often a new link can be mailed to the same
+	// user, so the forgot-password endpoint cannot be used to flood inboxes.
+	userTokenCooldown = time.Minute
+	mailSendTimeout   = 30 * time.Second
+)
+
+var (
+	errUserTokenInvalid     = errors.New("invalid or expired token")
+	errUserTokenCooldown    = errors.New("a link was sent recently")
+	errEmailAlreadyVerified = errors.New("email already verified")
+	errCurrentPassword      = errors.New("current password is incorrect")
+)
+
+func passwordThrottleKey(userID uint) string {
+	return "password:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+func (s *Server) forgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	// The response never reveals whether the email is registered.
+	var user models.User
+	if err := s.dbFor(c).Where("email = ?", req.Email).First(&user).Error; err != nil {
+		if !errorsIs(err, gorm.ErrRecordNotFound) {
+			respondError(c, http.StatusInternalServerError, "failed to fetch user")
+			return
+		}
+		c.Status(http.StatusAccepted)
+		return
+	}
+	if user.DisabledAt != nil {
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	token, err := s.issueUserToken(c.Request.Context(), user.ID, userTokenPasswordReset, s.cfg.PasswordResetTTL)
+	if err != nil {
+		if errors.Is(err, errUserTokenCooldown) {
+			c.Status(http.StatusAccepted)
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to create reset token")
+		return
+	}
+
+	s.sendMail(c.Request.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your bsmart password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your bsmart account.\n\n"+
+			"Open this link to choose a new one (valid for %s):\n%s\n\n"+
+			"If it was not you, ignore this email.\n",
+			s.cfg.PasswordResetTTL, s.mailLink("reset-password", token)),
+	})
+
+	c.Status(http.StatusAccepted)
+}
+
+func (s *Server) resetPassword(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+
+	var revoked []string
+	err = s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, req.Token, userTokenPasswordReset)
+		if err != nil {
+			return err
+		}
+
+		// Following the link proves control of the mailbox.
+		if err := tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", token.UserID).
+			Update("email_verified_at", time.Now()).Error; err != nil {
+			return err
+		}
+		revoked, err = setPassword(tx, token.UserID, string(hash), "")
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errUserTokenInvalid) {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to reset password")
+		return
+	}
+	s.closeSessions(revoked)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) changePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	throttleKey := passwordThrottleKey(user.ID)
+	if wait := s.loginThrottle.wait(throttleKey); wait > 0 {
+		c.Header("Retry-After", retryAfterSeconds(wait))
+		respondError(c, http.StatusTooManyRequests, "too many attempts")
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		s.loginThrottle.fail(throttleKey)
+		respondError(c, http.StatusBadRequest, errCurrentPassword.Error())
+		return
+	}
+	s.loginThrottle.reset(throttleKey)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+
+	// The session that changed the password stays signed in.
+	var revoked []string
+	if err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		revoked, err = setPassword(tx, user.ID, string(hash), getAuthContext(c).SessionID)
+		return err
+	}); err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to change password")
+		return
+	}
+	s.closeSessions(revoked)
+
+	s.sendMail(c.Request.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Your bsmart password was changed",
+		Body:    "The password of your bsmart account was just changed. If it was not you, contact an administrator.\n",
+	})
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) requestEmailVerification(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		respondError(c, http.StatusConflict, errEmailAlreadyVerified.Error())
+		return
+	}
+
+	if err := s.sendEmailVerification(c.Request.Context(), user); err != nil {
+		if errors.Is(err, errUserTokenCooldown) {
+			respondError(c, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to create verification token")
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func (s *Server) verifyEmail(c *gin.Context) {
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		token, err := consumeUserToken(tx, req.Token, userTokenEmailVerify)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", token.UserID).
+			Update("email_verified_at", time.Now()).Error
+	})
+	if err != nil {
+		if errors.Is(err, errUserTokenInvalid) {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to verify email")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) sendEmailVerification(ctx context.Context, user *models.User) error {
+	token, err := s.issueUserToken(ctx, user.ID, userTokenEmailVerify, s.cfg.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your bsmart email",
+		Body: fmt.Sprintf("Confirm this address for your bsmart account (link valid for %s):\n%s\n",
+			s.cfg.EmailVerificationTTL, s.mailLink("verify-email", token)),
+	})
+	return nil
+}
+
+// issueUserToken stores the hash of a new single-use token. Older unused
+// tokens for the same purpose stay valid until they expire or one is used.
+func (s *Server) issueUserToken(ctx context.Context, userID uint, purpose string, ttl time.Duration) (string, error) {
+	var recent int64
+	if err := s.db.WithContext(ctx).Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, time.Now().Add(-userTokenCooldown)).
+		Count(&recent).Error; err != nil {
+		return "", err
+	}
+	if recent > 0 {
+		return "", errUserTokenCooldown
+	}
+
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	record := models.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashToken(raw),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.db.WithContext(ctx).Create(&record).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeUserToken marks the token used and retires every other unused token
+// of the same purpose for that user.
+func consumeUserToken(tx *gorm.DB, raw, purpose string) (*models.UserToken, error) {
+	var token models.UserToken
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND purpose = ?", hashToken(raw), purpose).
+		First(&token).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			return nil, errUserTokenInvalid
+		}
+		return nil, err
+	}
+	if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		return nil, errUserTokenInvalid
+	}
+
+	if err := tx.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", token.UserID, purpose).
+		Update("used_at", time.Now()).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// setPassword also clears any lockout and signs the user out of every session
+// but keep, returning the revoked ones for closeSessions.
+func setPassword(tx *gorm.DB, userID uint, hash, keep string) ([]string, error) {
+	res := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"password_hash": hash,
+		"failed_logins": 0,
+		"locked_until":  nil,
+	})
+	if err := res.Error; err != nil {
+		return nil, err
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	if err := tx.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, userTokenPasswordReset).
+		Update("used_at", time.Now()).Error; err != nil {
+		return nil, err
+	}
+	return revokeUserSessions(tx, userID, keep)
+}
+
+func (s *Server) mailLink(page, token string) string {
+	return s.cfg.MailLinkBaseURL + "/" + page + "?token=" + url.QueryEscape(token)
+}
+
+// sendMail delivers in the background so response times do not depend on the
+// mail server (or leak whether an address is registered). ctx only lends its
+// request ID and trace; the delivery outlives the request.
+func (s *Server) sendMail(ctx context.Context, msg mailer.Message) {
+	s.background(func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailSendTimeout)
+		defer cancel()
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "mail delivery failed", "subject", msg.Subject, "to", msg.To, "error", err)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	apiKeyHeader          = "X-API-Key"
+	apiKeyPrefix          = "bsk_"
+	apiKeyLastUsedEvery   = time.Minute
+	apiKeyDisplayedPrefix = 12
+)
+
+var (
+	errInvalidAPIKey  = errors.New("invalid api key")
+	errScopeForbidden = errors.New("cannot grant permissions you do not have")
+)
+
+func (s *Server) authenticateAPIKey(ctx context.Context, raw string) (*AuthContext, error) {
+	return s.apiKeyAuth(ctx, "key_hash = ?", hashToken(raw))
+}
+
+func (s *Server) apiKeyAuth(ctx context.Context, query string, arg interface{}) (*AuthContext, error) {
+	var key models.APIKey
+	if err := s.db.WithContext(ctx).Preload("Scopes").Where(query, arg).First(&key).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			return nil, errInvalidAPIKey
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	if key.RevokedAt != nil || now.After(key.ExpiresAt) {
+		return nil, errInvalidAPIKey
+	}
+
+	// Only touch last_used_at once per interval to avoid a write on every call.
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyLastUsedEvery {
+		if err := s.db.WithContext(ctx).Model(&models.APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	perms := make(permissionSet, len(key.Scopes))
+	for _, scope := range key.Scopes {
+		perms[scope.Name] = struct{}{}
+	}
+
+	return &AuthContext{APIKeyID: key.ID, OrgID: key.OrganizationID, ExpiresAt: key.ExpiresAt, Permissions: perms}, nil
+}
+
+func (s *Server) listAPIKeys(c *gin.Context) {
+	var keys []models.APIKey
+	if err := s.dbFor(c).Scopes(inTenant("api_keys", getAuthContext(c).OrgID)).
+		Preload("Scopes").Order("created_at desc").Find(&keys).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch api keys")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": keys})
+}
+
+func (s *Server) createAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	if !req.ExpiresAt.After(time.Now()) {
+		respondError(c, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	auth := getAuthContext(c)
+	for _, scope := range req.Scopes {
+		if !auth.Can(scope) {
+			respondError(c, http.StatusForbidden, errScopeForbidden.Error())
+			return
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate api key")
+		return
+	}
+	raw := apiKeyPrefix + secret
+
+	key := models.APIKey{
+		OrganizationID: auth.OrgID,
+		Name:           req.Name,
+		Prefix:         raw[:apiKeyDisplayedPrefix],
+		KeyHash:        hashToken(raw),
+		CreatedByID:    auth.UserID,
+		ExpiresAt:      req.ExpiresAt,
+	}
+
+	err = s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		scopes, err := findPermissions(tx, req.Scopes)
+		if err != nil {
+			return err
+		}
+		key.Scopes = scopes
+		return tx.Create(&key).Error
+	})
+	if err != nil {
+		if errors.Is(err, errUnknownPermissions) {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to create api key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": key,
+		"key":  raw,
+	})
+}
+
+func (s *Server) revokeAPIKey(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	res := s.dbFor(c).Model(&models.APIKey{}).
+		Scopes(inTenant("api_keys", getAuthContext(c).OrgID)).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+	if err := res.Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to revoke api key")
+		return
+	}
+
+	if res.RowsAffected == 0 {
+		respondError(c, http.StatusNotFound, "api key not found")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
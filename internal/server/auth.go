@@ -3,47 +3,101 @@ package server
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/gorilla/websocket"
+)
+
+const (
+	challengePurposeMFA       = "mfa"
+	challengePurposeMFAEnroll = "mfa_enroll"
+	challengeTTL              = 5 * time.Minute
 )
 
 type AuthClaims struct {
-	UserID uint   `json:"user_id"`
-	Role   string `json:"role"`
+	UserID    uint   `json:"user_id"`
+	Role      string `json:"role"`
+	OrgID     uint   `json:"org_id,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func (s *Server) authMiddleware(requiredRoles ...string) gin.HandlerFunc {
+// authMiddleware authenticates the caller and, when permissions are given,
+// requires at least one of them.
+func (s *Server) authMiddleware(requiredPermissions ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenStr, err := s.extractToken(c)
-		if err != nil {
-			respondError(c, http.StatusUnauthorized, err.Error())
-			c.Abort()
-			return
-		}
-
-		claims, err := s.parseToken(tokenStr)
+		auth, status, err := s.authenticate(c)
 		if err != nil {
-			respondError(c, http.StatusUnauthorized, "invalid token")
+			respondError(c, status, err.Error())
 			c.Abort()
 			return
 		}
 
-		if len(requiredRoles) > 0 && !roleAllowed(claims.Role, requiredRoles) {
+		if len(requiredPermissions) > 0 && !auth.Permissions.hasAny(requiredPermissions) {
 			respondError(c, http.StatusForbidden, "forbidden")
 			c.Abort()
 			return
 		}
 
-		c.Set(userContextKey, &AuthContext{UserID: claims.UserID, Role: claims.Role})
+		c.Set(userContextKey, auth)
 		c.Next()
 	}
 }
 
+// authenticate accepts either an API key (X-API-Key) or a bearer JWT and
+// returns the HTTP status to use when it fails.
+func (s *Server) authenticate(c *gin.Context) (*AuthContext, int, error) {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		auth, err := s.authenticateAPIKey(c.Request.Context(), key)
+		if err != nil {
+			if errors.Is(err, errInvalidAPIKey) {
+				return nil, http.StatusUnauthorized, err
+			}
+			return nil, http.StatusInternalServerError, errors.New("failed to verify api key")
+		}
+		return auth, 0, nil
+	}
+
+	tokenStr, err := s.extractToken(c)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	return s.authenticateToken(tokenStr)
+}
+
+// authenticateToken validates an access token, including its session.
+func (s *Server) authenticateToken(tokenStr string) (*AuthContext, int, error) {
+	claims, err := s.parseToken(tokenStr)
+	if err != nil || claims.OrgID == 0 || claims.SessionID == "" {
+		return nil, http.StatusUnauthorized, errors.New("invalid token")
+	}
+
+	if err := s.sessions.check(claims.SessionID, claims.UserID); err != nil {
+		if errors.Is(err, errSessionRevoked) {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, errors.New("failed to verify session")
+	}
+
+	perms, err := s.permissions.forRole(claims.Role)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed to load permissions")
+	}
+
+	return &AuthContext{
+		UserID:      claims.UserID,
+		Role:        claims.Role,
+		OrgID:       claims.OrgID,
+		SessionID:   claims.SessionID,
+		ExpiresAt:   claims.ExpiresAt.Time,
+		Permissions: perms,
+	}, 0, nil
+}
+
 func (s *Server) extractToken(c *gin.Context) (string, error) {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader != "" {
@@ -54,23 +108,37 @@ func (s *Server) extractToken(c *gin.Context) (string, error) {
 		return parts[1], nil
 	}
 
-	if websocket.IsWebSocketUpgrade(c.Request) || c.FullPath() == "/ws" {
-		if token := c.Query("token"); token != "" {
-			return token, nil
-		}
-	}
-
 	return "", errors.New("missing authorization token")
 }
 
 func (s *Server) parseToken(tokenStr string) (*AuthClaims, error) {
+	claims, err := s.parseClaims(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("not an access token")
+	}
+	return claims, nil
+}
+
+func (s *Server) parseChallengeToken(tokenStr, purpose string) (*AuthClaims, error) {
+	claims, err := s.parseClaims(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, errors.New("unexpected token purpose")
+	}
+	return claims, nil
+}
+
+func (s *Server) parseClaims(tokenStr string) (*AuthClaims, error) {
 	claims := &AuthClaims{}
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return s.tokenSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenStr, claims, s.keys.keyFunc,
+		jwt.WithValidMethods(s.keys.validMethods()),
+		jwt.WithIssuer(s.cfg.JWTIssuer),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -80,26 +148,44 @@ func (s *Server) parseToken(tokenStr string) (*AuthClaims, error) {
 	return claims, nil
 }
 
-func roleAllowed(role string, allowed []string) bool {
-	for _, r := range allowed {
-		if strings.EqualFold(r, role) {
-			return true
-		}
+func (s *Server) generateToken(userID uint, role string, orgID uint, sessionID string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
 	}
-	return false
-}
 
-func (s *Server) generateToken(userID uint, role string) (string, error) {
 	now := time.Now()
 	claims := AuthClaims{
-		UserID: userID,
-		Role:   role,
+		UserID:    userID,
+		Role:      role,
+		OrgID:     orgID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    s.cfg.JWTIssuer,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.tokenSecret)
+	return s.keys.sign(claims)
+}
+
+// generateChallengeToken issues a short-lived token that only proves the
+// password step of a login; it is rejected everywhere an access token is.
+func (s *Server) generateChallengeToken(userID uint, purpose string) (string, error) {
+	now := time.Now()
+	claims := AuthClaims{
+		UserID:  userID,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.cfg.JWTIssuer,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			ExpiresAt: jwt.NewNumericDate(now.Add(challengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return s.keys.sign(claims)
 }
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"errors"
+	"log/slog"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 
 	"github.com/ignimbrite/bsmart-challenge/internal/models"
 )
@@ -16,26 +21,187 @@ func (s *Server) login(c *gin.Context) {
 		return
 	}
 
+	throttleKeys := loginThrottleKeys(c.ClientIP(), req.Email)
+	if wait := s.loginThrottle.wait(throttleKeys...); wait > 0 {
+		slog.WarnContext(c.Request.Context(), "login throttled", "email", req.Email, "ip", c.ClientIP(), "retry_after", wait.Round(time.Second).String())
+		s.metrics.loginFailed(loginFailureThrottled)
+		c.Header("Retry-After", retryAfterSeconds(wait))
+		respondError(c, http.StatusTooManyRequests, "too many login attempts")
+		return
+	}
+
 	var user models.User
-	if err := s.db.Where("email = ?", req.Email).First(&user).Error; err != nil {
+	if err := s.dbFor(c).Where("email = ?", req.Email).First(&user).Error; err != nil {
+		s.loginThrottle.fail(throttleKeys...)
+		s.metrics.loginFailed(loginFailureCredentials)
 		respondError(c, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
 
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		slog.WarnContext(c.Request.Context(), "login rejected for locked account", "user_id", user.ID, "ip", c.ClientIP())
+		s.metrics.loginFailed(loginFailureLocked)
+		c.Header("Retry-After", retryAfterSeconds(time.Until(*user.LockedUntil)))
+		respondError(c, http.StatusLocked, "account locked")
+		return
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.loginThrottle.fail(throttleKeys...)
+		lockedUntil, lockErr := s.recordFailedLogin(c.Request.Context(), user.ID)
+		if lockErr != nil {
+			respondError(c, http.StatusInternalServerError, "failed to record login attempt")
+			return
+		}
+		if lockedUntil != nil {
+			s.metrics.loginFailed(loginFailureLocked)
+			c.Header("Retry-After", retryAfterSeconds(time.Until(*lockedUntil)))
+			respondError(c, http.StatusLocked, "account locked")
+			return
+		}
+		s.metrics.loginFailed(loginFailureCredentials)
 		respondError(c, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
 
-	token, err := s.generateToken(user.ID, user.Role)
+	if user.DisabledAt != nil {
+		s.metrics.loginFailed(loginFailureDisabled)
+		respondError(c, http.StatusForbidden, "account disabled")
+		return
+	}
+
+	s.loginThrottle.reset(throttleKeys...)
+	if err := s.clearFailedLogins(c.Request.Context(), &user); err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to record login attempt")
+		return
+	}
+
+	s.finishLogin(c, &user)
+}
+
+// finishLogin runs the second-factor steps shared by every primary login
+// method and then issues tokens.
+func (s *Server) finishLogin(c *gin.Context, user *models.User) {
+	if user.TOTPEnabledAt != nil {
+		s.respondChallenge(c, user, challengePurposeMFA)
+		return
+	}
+
+	required, err := s.roleRequiresMFA(c.Request.Context(), user.Role)
 	if err != nil {
-		respondError(c, http.StatusInternalServerError, "failed to generate token")
+		respondError(c, http.StatusInternalServerError, "failed to fetch role")
 		return
 	}
+	if required {
+		s.respondChallenge(c, user, challengePurposeMFAEnroll)
+		return
+	}
+
+	s.completeLogin(c, user, nil)
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"role":  user.Role,
-		"email": user.Email,
+func (s *Server) completeLogin(c *gin.Context, user *models.User, extra gin.H) {
+	org, err := userOrganization(s.dbFor(c), user.ID, 0)
+	if err != nil {
+		respondOrganizationError(c, err, "failed to fetch organization")
+		return
+	}
+
+	var (
+		session      *models.Session
+		refreshToken string
+	)
+	err = s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		session, err = s.createSession(tx, c, "", user.ID, org.ID)
+		if err != nil {
+			return err
+		}
+		refreshToken, _, err = s.issueRefreshToken(tx, user.ID, org.ID, session.ID)
+		return err
 	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	token, err := s.generateToken(user.ID, user.Role, org.ID, session.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	s.metrics.loginSucceeded()
+	s.respondTokens(c, user, org, token, refreshToken, extra)
+}
+
+func (s *Server) refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	rotated, err := s.rotateRefreshToken(c, req.RefreshToken, req.OrganizationID)
+	if err != nil {
+		switch {
+		case errors.Is(err, errRefreshTokenInvalid), errors.Is(err, errRefreshTokenExpired),
+			errors.Is(err, errRefreshTokenReused), errors.Is(err, errSessionRevoked):
+			respondError(c, http.StatusUnauthorized, err.Error())
+		default:
+			respondOrganizationError(c, err, "failed to refresh token")
+		}
+		return
+	}
+
+	user, org := rotated.user, rotated.org
+	token, err := s.generateToken(user.ID, user.Role, org.ID, rotated.sessionID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	s.respondTokens(c, user, org, token, rotated.token, nil)
+}
+
+func (s *Server) logout(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ids, err := s.revokeRefreshToken(req.RefreshToken)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to logout")
+		return
+	}
+	s.closeSessions(ids)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) respondTokens(c *gin.Context, user *models.User, org *models.Organization, token, refreshToken string, extra gin.H) {
+	perms, err := s.permissions.forRole(user.Role)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to load permissions")
+		return
+	}
+
+	permissions := perms.list()
+	sort.Strings(permissions)
+
+	body := gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"role":          user.Role,
+		"permissions":   permissions,
+		"email":         user.Email,
+		"organization":  org,
+	}
+	for key, value := range extra {
+		body[key] = value
+	}
+
+	c.JSON(http.StatusOK, body)
 }
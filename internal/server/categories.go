@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -25,7 +26,7 @@ func (s *Server) listCategories(c *gin.Context) {
 
 	order := sanitizeSort(query.Sort, categorySortOptions, "created_at desc")
 
-	db := s.db.Model(&models.Category{})
+	db := s.dbFor(c).Model(&models.Category{}).Scopes(inTenant("categories", getAuthContext(c).OrgID))
 
 	if query.Query != "" {
 		like := "%" + query.Query + "%"
@@ -52,16 +53,27 @@ func (s *Server) createCategory(c *gin.Context) {
 	}
 
 	category := models.Category{
-		Name:        req.Name,
-		Description: req.Description,
+		OrganizationID: getAuthContext(c).OrgID,
+		Name:           req.Name,
+		Description:    req.Description,
 	}
 
-	if err := s.db.Create(&category).Error; err != nil {
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&category).Error; err != nil {
+			return err
+		}
+		return enqueueEvent(tx, category.OrganizationID, categoryMessage("category.created", category.ID, category))
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			respondError(c, http.StatusConflict, "category already exists")
+			return
+		}
 		respondError(c, http.StatusInternalServerError, "failed to create category")
 		return
 	}
 
-	s.wsHub.Broadcast(NewWSMessage("category.created", category))
+	s.wakeOutbox()
 
 	c.JSON(http.StatusCreated, gin.H{"data": category})
 }
@@ -79,7 +91,7 @@ func (s *Server) updateCategory(c *gin.Context) {
 	}
 
 	var category models.Category
-	if err := s.db.First(&category, id).Error; err != nil {
+	if err := s.dbFor(c).Scopes(inTenant("categories", getAuthContext(c).OrgID)).First(&category, id).Error; err != nil {
 		if errorsIs(err, gorm.ErrRecordNotFound) {
 			respondError(c, http.StatusNotFound, "category not found")
 			return
@@ -95,12 +107,22 @@ func (s *Server) updateCategory(c *gin.Context) {
 		category.Description = req.Description
 	}
 
-	if err := s.db.Save(&category).Error; err != nil {
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&category).Error; err != nil {
+			return err
+		}
+		return enqueueEvent(tx, category.OrganizationID, categoryMessage("category.updated", category.ID, category))
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			respondError(c, http.StatusConflict, "category already exists")
+			return
+		}
 		respondError(c, http.StatusInternalServerError, "failed to update category")
 		return
 	}
 
-	s.wsHub.Broadcast(NewWSMessage("category.updated", category))
+	s.wakeOutbox()
 
 	c.JSON(http.StatusOK, gin.H{"data": category})
 }
@@ -111,18 +133,27 @@ func (s *Server) deleteCategory(c *gin.Context) {
 		return
 	}
 
-	res := s.db.Delete(&models.Category{}, id)
-	if err := res.Error; err != nil {
+	orgID := getAuthContext(c).OrgID
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Scopes(inTenant("categories", orgID)).Delete(&models.Category{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return enqueueEvent(tx, orgID, categoryMessage("category.deleted", id, gin.H{"id": id}))
+	})
+	if err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			respondError(c, http.StatusNotFound, "category not found")
+			return
+		}
 		respondError(c, http.StatusInternalServerError, "failed to delete category")
 		return
 	}
 
-	if res.RowsAffected == 0 {
-		respondError(c, http.StatusNotFound, "category not found")
-		return
-	}
-
-	s.wsHub.Broadcast(NewWSMessage("category.deleted", gin.H{"id": id}))
+	s.wakeOutbox()
 
 	c.Status(http.StatusNoContent)
 }
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/logging"
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+	"github.com/ignimbrite/bsmart-challenge/internal/tracing"
+)
+
+const (
+	// eventLogLock serializes inserts into the event log so sequence numbers
+	// become visible in order, also across replicas.
+	eventLogLock      = 0x62736d617274
+	eventReplayPage   = 500
+	eventCompactEvery = 10 * time.Minute
+	// Bounds how long the dispatcher waits on the bus for a batch.
+	eventPublishTimeout = 5 * time.Second
+	outboxPollEvery     = time.Second
+	outboxBatchSize     = 500
+)
+
+// enqueueEvent records the event in the outbox within tx, the transaction
+// that makes the change it reports, so the event exists if and only if the
+// change was committed. The request ID and trace of tx's context travel with
+// it to the clients. Call wakeOutbox once tx has committed.
+func enqueueEvent(tx *gorm.DB, orgID uint, msg WSMessage) error {
+	payload, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&models.OutboxEvent{
+		OrganizationID: orgID,
+		Type:           msg.Event,
+		Topics:         strings.Join(msg.Topics, ","),
+		Payload:        payload,
+		RequestID:      logging.RequestID(tx.Statement.Context),
+		TraceParent:    tracing.Inject(tx.Statement.Context),
+	}).Error
+}
+
+func (s *Server) wakeOutbox() {
+	select {
+	case s.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox dispatches committed outbox events, polling so that events left
+// behind by a crash or written by another replica are picked up too. On
+// shutdown it dispatches what is left before returning.
+func (s *Server) runOutbox() {
+	ticker := time.NewTicker(outboxPollEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.outboxWake:
+		case <-s.ctx.Done():
+			s.drainOutbox()
+			return
+		}
+		s.drainOutbox()
+	}
+}
+
+func (s *Server) drainOutbox() {
+	for {
+		dispatched, err := s.dispatchOutbox()
+		if err != nil {
+			slog.Error("outbox dispatch failed", "error", err)
+		}
+		if dispatched < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// dispatchOutbox moves a batch of pending outbox events into the event log,
+// which assigns their sequence numbers, and queues their webhook deliveries,
+// all in one transaction. It then hands the events to the bus for the hubs.
+// A crash after the commit only skips the live push: the events are already
+// in the log, for replay and for the postgres bus to catch up on.
+func (s *Server) dispatchOutbox() (int, error) {
+	var events []models.Event
+	hooks := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", eventLogLock).Error; err != nil {
+			return err
+		}
+
+		var pending []models.OutboxEvent
+		if err := tx.Where("dispatched_at IS NULL").
+			Order("id asc").
+			Limit(outboxBatchSize).
+			Find(&pending).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, row := range pending {
+			event := models.Event{
+				OrganizationID: row.OrganizationID,
+				Type:           row.Type,
+				Topics:         row.Topics,
+				Payload:        row.Payload,
+				RequestID:      row.RequestID,
+				TraceParent:    row.TraceParent,
+			}
+			if err := tx.Create(&event).Error; err != nil {
+				return err
+			}
+			queued, err := enqueueWebhooks(tx, event)
+			if err != nil {
+				return err
+			}
+			hooks += queued
+
+			if err := tx.Model(&models.OutboxEvent{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"event_seq":     event.Seq,
+				"dispatched_at": now,
+			}).Error; err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if hooks > 0 {
+		s.wakeWebhooks()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+	defer cancel()
+	for _, event := range events {
+		if err := s.bus.Publish(ctx, event); err != nil {
+			slog.Error("event bus publish failed", "seq", event.Seq, "error", err)
+		}
+	}
+	return len(events), nil
+}
+
+// deliverEvent receives every event from the bus and hands it to the local
+// hub, within the trace of the request that caused it.
+func (s *Server) deliverEvent(event models.Event) {
+	ctx := tracing.Extract(context.Background(), event.TraceParent)
+	s.wsHub.Broadcast(ctx, event.OrganizationID, eventMessage(event))
+}
+
+// runEventBus keeps the bus subscription alive for the life of the process.
+func (s *Server) runEventBus() {
+	if err := s.bus.Run(s.ctx, s.deliverEvent); err != nil && s.ctx.Err() == nil {
+		slog.Error("event bus stopped", "error", err)
+	}
+}
+
+func eventMessage(event models.Event) WSMessage {
+	msg := WSMessage{
+		Event:     event.Type,
+		Data:      json.RawMessage(event.Payload),
+		Seq:       event.Seq,
+		RequestID: event.RequestID,
+	}
+	if event.Topics != "" {
+		msg.Topics = strings.Split(event.Topics, ",")
+	}
+	return msg
+}
+
+// replayAvailable reports whether every event after since is still in the
+// log. since is the last sequence the client saw, so it must still be there:
+// compaction removes the oldest events first.
+func (s *Server) replayAvailable(orgID uint, since uint64) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.Event{}).
+		Where("organization_id = ? AND seq = ?", orgID, since).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// replay writes the events the client missed straight to the connection,
+// before live delivery starts, and returns the last sequence sent.
+func (c *Client) replay(since uint64) (uint64, error) {
+	orgID := c.authContext().OrgID
+
+	ok, err := c.srv.replayAvailable(orgID, since)
+	if err != nil {
+		return since, err
+	}
+	if !ok {
+		return since, c.write(NewWSMessage("replay.unavailable", gin.H{
+			"since": since,
+			"error": "events after this sequence are no longer available; reload the data and reconnect without since",
+		}))
+	}
+
+	last := since
+	for {
+		var events []models.Event
+		if err := c.srv.db.Where("organization_id = ? AND seq > ?", orgID, last).
+			Order("seq asc").
+			Limit(eventReplayPage).
+			Find(&events).Error; err != nil {
+			return last, err
+		}
+
+		for _, event := range events {
+			last = event.Seq
+			msg := eventMessage(event)
+			if !c.subscribedToAny(msg.Topics) {
+				continue
+			}
+			if err := c.write(msg); err != nil {
+				return last, err
+			}
+		}
+		if len(events) < eventReplayPage {
+			break
+		}
+	}
+
+	return last, c.write(NewWSMessage("replay.done", gin.H{"seq": last}))
+}
+
+// compactEvents drops events older than EVENT_RETENTION and dispatched
+// outbox rows older than OUTBOX_RETENTION.
+func (s *Server) compactEvents() {
+	ticker := time.NewTicker(eventCompactEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		cutoff := time.Now().Add(-s.cfg.EventRetention)
+		if err := s.db.Where("created_at < ?", cutoff).Delete(&models.Event{}).Error; err != nil {
+			slog.Error("event log compaction failed", "error", err)
+		}
+
+		cutoff = time.Now().Add(-s.cfg.OutboxRetention)
+		if err := s.db.Where("dispatched_at < ?", cutoff).Delete(&models.OutboxEvent{}).Error; err != nil {
+			slog.Error("outbox compaction failed", "error", err)
+		}
+	}
+}
@@ -4,15 +4,26 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 const userContextKey = "user"
 
 type AuthContext struct {
-	UserID uint
-	Role   string
+	UserID      uint
+	Role        string
+	APIKeyID    uint
+	OrgID       uint
+	SessionID   string
+	ExpiresAt   time.Time
+	Permissions permissionSet
+}
+
+func (a *AuthContext) Can(perm string) bool {
+	return a != nil && a.Permissions.has(perm)
 }
 
 func getAuthContext(c *gin.Context) *AuthContext {
@@ -26,6 +37,13 @@ func getAuthContext(c *gin.Context) *AuthContext {
 	return nil
 }
 
+// inTenant restricts a query on table to the caller's organization.
+func inTenant(table string, orgID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(table+".organization_id = ?", orgID)
+	}
+}
+
 func respondError(c *gin.Context, status int, msg string) {
 	c.JSON(status, gin.H{"error": msg})
 }
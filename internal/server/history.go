@@ -12,5 +12,9 @@ func (s *Server) recordHistory(db *gorm.DB, productID uint, price float64, stock
 		Price:     price,
 		Stock:     stock,
 	}
-	return db.Create(&entry).Error
+	if err := db.Create(&entry).Error; err != nil {
+		return err
+	}
+	s.metrics.historyRows.Inc()
+	return nil
 }
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/config"
+)
+
+const minRSAKeyBits = 2048
+
+type verificationKey struct {
+	id     string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+// KeySet holds the key used to sign new tokens and every key accepted when
+// verifying them. Without a signing key file it falls back to HS256 with the
+// shared secret, and the JWKS document is empty.
+type KeySet struct {
+	hmacSecret []byte
+	signer     crypto.Signer
+	signing    *verificationKey
+	verify     map[string]*verificationKey
+}
+
+func NewHMACKeySet(secret []byte) *KeySet {
+	return &KeySet{hmacSecret: secret}
+}
+
+// placeholderSecrets are the JWT_SECRET values shipped in the defaults and
+// .env.example, which anyone can sign tokens with.
+var placeholderSecrets = map[string]bool{"": true, "dev-secret": true, "replace-me": true}
+
+// LoadKeySet refuses to fall back to HS256 outside development unless
+// JWT_SECRET was set to a secret of its own.
+func LoadKeySet(cfg config.Config) (*KeySet, error) {
+	if cfg.JWTSigningKeyFile == "" {
+		if cfg.AppEnv != "development" && placeholderSecrets[cfg.JWTSecret] {
+			return nil, errors.New("JWT_SIGNING_KEY_FILE is required outside development (or a JWT_SECRET other than the default)")
+		}
+		slog.Warn("signing tokens with HS256 and JWT_SECRET; set JWT_SIGNING_KEY_FILE to sign with a private key and publish it in the JWKS", "env", cfg.AppEnv)
+		return NewHMACKeySet([]byte(cfg.JWTSecret)), nil
+	}
+
+	signer, err := loadPrivateKey(cfg.JWTSigningKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %w", cfg.JWTSigningKeyFile, err)
+	}
+
+	signing, err := newVerificationKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %w", cfg.JWTSigningKeyFile, err)
+	}
+
+	keys := &KeySet{
+		signer:  signer,
+		signing: signing,
+		verify:  map[string]*verificationKey{signing.id: signing},
+	}
+
+	for _, path := range cfg.JWTVerifyKeyFiles {
+		public, err := loadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("verification key %s: %w", path, err)
+		}
+		key, err := newVerificationKey(public)
+		if err != nil {
+			return nil, fmt.Errorf("verification key %s: %w", path, err)
+		}
+		keys.verify[key.id] = key
+	}
+
+	return keys, nil
+}
+
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	if k.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.hmacSecret)
+	}
+
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.id
+	return token.SignedString(k.signer)
+}
+
+func (k *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if k.signing == nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return k.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.verify[kid]
+	if !ok {
+		return nil, errors.New("unknown key id")
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.public, nil
+}
+
+func (k *KeySet) validMethods() []string {
+	if k.signing == nil {
+		return []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodHS384.Alg(), jwt.SigningMethodHS512.Alg()}
+	}
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+func (k *KeySet) jwks() gin.H {
+	keys := make([]gin.H, 0, len(k.verify))
+	for _, key := range k.verify {
+		jwk := publicJWK(key.public)
+		jwk["kid"] = key.id
+		jwk["use"] = "sig"
+		jwk["alg"] = key.method.Alg()
+		keys = append(keys, jwk)
+	}
+	return gin.H{"keys": keys}
+}
+
+func (s *Server) serveJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, s.keys.jwks())
+}
+
+func newVerificationKey(public crypto.PublicKey) (*verificationKey, error) {
+	var method jwt.SigningMethod
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("rsa key must be at least %d bits", minRSAKeyBits)
+		}
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	id, err := thumbprint(public)
+	if err != nil {
+		return nil, err
+	}
+	return &verificationKey{id: id, method: method, public: public}, nil
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint, used as the kid so every service
+// derives the same id from the same key.
+func thumbprint(public crypto.PublicKey) (string, error) {
+	jwk := publicJWK(public)
+	var canonical string
+	switch jwk["kty"] {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk["e"], jwk["n"])
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk["crv"], jwk["x"])
+	default:
+		return "", fmt.Errorf("unsupported key type %T", public)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func publicJWK(public crypto.PublicKey) gin.H {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return gin.H{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return gin.H{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(key),
+		}
+	default:
+		return gin.H{}
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return block, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// loadPublicKey also accepts private key files so a retired signing key can be
+// listed as-is.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "RSA PRIVATE KEY", "PRIVATE KEY":
+		signer, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return signer.Public(), nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	loginThrottleWindow = 15 * time.Minute
+	loginThrottlePrune  = time.Minute
+)
+
+type throttleEntry struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+// loginThrottle applies exponential backoff per IP and per email after failed
+// logins. It is per replica; the account lockout in the database is shared.
+type loginThrottle struct {
+	base      time.Duration
+	max       time.Duration
+	mu        sync.Mutex
+	entries   map[string]*throttleEntry
+	lastPrune time.Time
+}
+
+func newLoginThrottle(base, maxDelay time.Duration) *loginThrottle {
+	return &loginThrottle{
+		base:    base,
+		max:     maxDelay,
+		entries: make(map[string]*throttleEntry),
+	}
+}
+
+func loginThrottleKeys(ip, email string) []string {
+	return []string{"ip:" + ip, emailThrottleKey(email)}
+}
+
+func emailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func (t *loginThrottle) wait(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var longest time.Duration
+	for _, key := range keys {
+		if entry, ok := t.entries[key]; ok && entry.until.After(now) {
+			if remaining := entry.until.Sub(now); remaining > longest {
+				longest = remaining
+			}
+		}
+	}
+	return longest
+}
+
+func (t *loginThrottle) fail(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok || now.Sub(entry.last) > loginThrottleWindow {
+			entry = &throttleEntry{}
+			t.entries[key] = entry
+		}
+		entry.failures++
+		entry.last = now
+		entry.until = now.Add(t.backoff(entry.failures))
+	}
+
+	if now.Sub(t.lastPrune) > loginThrottlePrune {
+		for key, entry := range t.entries {
+			if now.Sub(entry.last) > loginThrottleWindow && now.After(entry.until) {
+				delete(t.entries, key)
+			}
+		}
+		t.lastPrune = now
+	}
+}
+
+func (t *loginThrottle) reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+func (t *loginThrottle) backoff(failures int) time.Duration {
+	delay := float64(t.base) * math.Pow(2, float64(failures-1))
+	if delay > float64(t.max) {
+		return t.max
+	}
+	return time.Duration(delay)
+}
+
+// recordFailedLogin bumps the user's failure counter and locks the account
+// once it reaches the configured maximum. It returns the lock expiry when the
+// account has just been locked.
+func (s *Server) recordFailedLogin(ctx context.Context, userID uint) (*time.Time, error) {
+	var lockedUntil *time.Time
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "email", "failed_logins").
+			First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"failed_logins": user.FailedLogins + 1}
+		if s.cfg.LoginMaxFailures > 0 && user.FailedLogins+1 >= s.cfg.LoginMaxFailures {
+			until := time.Now().Add(s.cfg.LoginLockout)
+			lockedUntil = &until
+			updates["failed_logins"] = 0
+			updates["locked_until"] = until
+			slog.WarnContext(tx.Statement.Context, "account locked", "user_id", user.ID, "email", user.Email, "until", until)
+		}
+
+		return tx.Model(&user).Updates(updates).Error
+	})
+
+	return lockedUntil, err
+}
+
+func (s *Server) clearFailedLogins(ctx context.Context, user *models.User) error {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return nil
+	}
+	return s.db.WithContext(ctx).Model(user).Updates(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
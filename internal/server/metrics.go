@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+const metricsNamespace = "bsmart"
+
+// Reasons a login is rejected, the reason label of bsmart_login_failures_total.
+const (
+	loginFailureCredentials = "invalid_credentials"
+	loginFailureLocked      = "locked"
+	loginFailureThrottled   = "throttled"
+	loginFailureDisabled    = "disabled"
+	loginFailureMFA         = "mfa"
+	loginFailureOIDC        = "oidc_denied"
+)
+
+// metrics holds the collectors served on /metrics. It uses its own registry
+// so only what is registered here is exposed.
+type metrics struct {
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	logins        prometheus.Counter
+	loginFailures *prometheus.CounterVec
+	historyRows   prometheus.Counter
+}
+
+func newMetrics(db *gorm.DB, hub *Hub) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		logins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "logins_total",
+			Help:      "Successful logins, by any method.",
+		}),
+		loginFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "login_failures_total",
+			Help:      "Rejected logins by reason.",
+		}, []string{"reason"}),
+		historyRows: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "product_history_rows_written_total",
+			Help:      "Price/stock history rows inserted.",
+		}),
+	}
+	for _, reason := range []string{loginFailureCredentials, loginFailureLocked, loginFailureThrottled, loginFailureDisabled, loginFailureMFA, loginFailureOIDC} {
+		m.loginFailures.WithLabelValues(reason)
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.latency,
+		m.logins,
+		m.loginFailures,
+		m.historyRows,
+		hubCollector{hub},
+	)
+	if sqlDB, err := db.DB(); err == nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(sqlDB, metricsNamespace))
+	}
+	return m
+}
+
+// middleware counts and times every request. Requests that match no route
+// share one label so scanners cannot grow the series without bound.
+func (m *metrics) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.latency.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *metrics) loginSucceeded() {
+	m.logins.Inc()
+}
+
+func (m *metrics) loginFailed(reason string) {
+	m.loginFailures.WithLabelValues(reason).Inc()
+}
+
+var (
+	hubClientsDesc      = prometheus.NewDesc(metricsNamespace+"_ws_clients", "Connected WebSocket and SSE clients.", nil, nil)
+	hubDroppedDesc      = prometheus.NewDesc(metricsNamespace+"_ws_dropped_total", "Events dropped from full client queues.", nil, nil)
+	hubCoalescedDesc    = prometheus.NewDesc(metricsNamespace+"_ws_coalesced_total", "Queued events replaced by a newer one of the same entity.", nil, nil)
+	hubDisconnectedDesc = prometheus.NewDesc(metricsNamespace+"_ws_disconnected_total", "Clients disconnected for falling behind.", nil, nil)
+)
+
+// hubCollector reads the hub's stats at scrape time.
+type hubCollector struct {
+	hub *Hub
+}
+
+func (h hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hubClientsDesc
+	ch <- hubDroppedDesc
+	ch <- hubCoalescedDesc
+	ch <- hubDisconnectedDesc
+}
+
+func (h hubCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := h.hub.Stats()
+	ch <- prometheus.MustNewConstMetric(hubClientsDesc, prometheus.GaugeValue, float64(stats.Clients))
+	ch <- prometheus.MustNewConstMetric(hubDroppedDesc, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(hubCoalescedDesc, prometheus.CounterValue, float64(stats.Coalesced))
+	ch <- prometheus.MustNewConstMetric(hubDisconnectedDesc, prometheus.CounterValue, float64(stats.Disconnected))
+}
+
+// metricsEnabled reports whether /metrics is served: it needs METRICS_TOKEN,
+// METRICS_ALLOWED_IPS or both.
+func (s *Server) metricsEnabled() bool {
+	return s.cfg.MetricsToken != "" || len(s.cfg.MetricsAllowedIPs) > 0
+}
+
+// metricsHandler serves the registry to callers that pass every configured
+// check: a bearer token equal to METRICS_TOKEN and a connecting address in
+// METRICS_ALLOWED_IPS. The address is the socket's, not X-Forwarded-For.
+func (s *Server) metricsHandler() gin.HandlerFunc {
+	allowed := parseIPAllowlist(s.cfg.MetricsAllowedIPs)
+	handler := promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+
+	return func(c *gin.Context) {
+		if len(s.cfg.MetricsAllowedIPs) > 0 {
+			addr, err := netip.ParseAddr(c.RemoteIP())
+			if err != nil || !ipAllowed(allowed, addr.Unmap()) {
+				respondError(c, http.StatusForbidden, "forbidden")
+				return
+			}
+		}
+		if s.cfg.MetricsToken != "" {
+			token, _ := s.extractToken(c)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.MetricsToken)) != 1 {
+				respondError(c, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// parseIPAllowlist accepts addresses and CIDR prefixes; invalid entries are
+// logged and left out, so they deny rather than allow.
+func parseIPAllowlist(entries []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				slog.Error("invalid METRICS_ALLOWED_IPS entry", "entry", entry, "error", err)
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			slog.Error("invalid METRICS_ALLOWED_IPS entry", "entry", entry, "error", err)
+			continue
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
+}
+
+func ipAllowed(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
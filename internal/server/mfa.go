@@ -0,0 +1,423 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	errMFAInvalidCode      = errors.New("invalid two-factor code")
+	errMFANotPending       = errors.New("two-factor setup not started")
+	errMFAAlreadyEnabled   = errors.New("two-factor authentication already enabled")
+	errMFANotEnabled       = errors.New("two-factor authentication not enabled")
+	errMFARequiredByRole   = errors.New("two-factor authentication is required for this role")
+	errUserTokenRequired   = errors.New("user token required")
+	errChallengeTokenUsage = errors.New("invalid challenge token")
+)
+
+func mfaThrottleKey(userID uint) string {
+	return "mfa:" + strconv.FormatUint(uint64(userID), 10)
+}
+
+func (s *Server) roleRequiresMFA(ctx context.Context, role string) (bool, error) {
+	var record models.Role
+	if err := s.db.WithContext(ctx).Select("require_mfa").Where("name = ?", role).First(&record).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return record.RequireMFA, nil
+}
+
+func (s *Server) respondChallenge(c *gin.Context, user *models.User, purpose string) {
+	token, err := s.generateChallengeToken(user.ID, purpose)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+
+	flag := "mfa_required"
+	if purpose == challengePurposeMFAEnroll {
+		flag = "mfa_enrollment_required"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		flag:              true,
+		"challenge_token": token,
+		"expires_in":      int(challengeTTL.Seconds()),
+	})
+}
+
+// verifyMFA checks a TOTP code or, failing that, an unused recovery code.
+func (s *Server) verifyMFA(ctx context.Context, user *models.User, code string) error {
+	if user.TOTPEnabledAt == nil {
+		return errMFANotEnabled
+	}
+
+	if step, ok := verifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		res := s.db.WithContext(ctx).Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errMFAInvalidCode
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	res := s.db.WithContext(ctx).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errMFAInvalidCode
+	}
+	return nil
+}
+
+func (s *Server) verifyMFALogin(c *gin.Context) {
+	var req MFAChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	user, ok := s.challengeUser(c, req.ChallengeToken, challengePurposeMFA)
+	if !ok {
+		return
+	}
+
+	if !s.checkMFACode(c, user, req.Code) {
+		s.metrics.loginFailed(loginFailureMFA)
+		return
+	}
+
+	s.completeLogin(c, user, nil)
+}
+
+func (s *Server) enrollMFALogin(c *gin.Context) {
+	var req MFAChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	user, ok := s.challengeUser(c, req.ChallengeToken, challengePurposeMFAEnroll)
+	if !ok {
+		return
+	}
+
+	if req.Code == "" {
+		s.startMFASetup(c, user)
+		return
+	}
+
+	codes, ok := s.confirmMFASetup(c, user, req.Code)
+	if !ok {
+		return
+	}
+
+	s.completeLogin(c, user, gin.H{"recovery_codes": codes})
+}
+
+func (s *Server) setupMFA(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	s.startMFASetup(c, user)
+}
+
+func (s *Server) enableMFA(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	codes, ok := s.confirmMFASetup(c, user, req.Code)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func (s *Server) disableMFA(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	required, err := s.roleRequiresMFA(c.Request.Context(), user.Role)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch role")
+		return
+	}
+	if required {
+		respondError(c, http.StatusConflict, errMFARequiredByRole.Error())
+		return
+	}
+
+	if !s.checkMFACode(c, user, req.Code) {
+		return
+	}
+
+	if err := clearMFA(s.dbFor(c), user.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to disable two-factor authentication")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) regenerateRecoveryCodes(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	if !s.checkMFACode(c, user, req.Code) {
+		return
+	}
+
+	var codes []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate recovery codes")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func (s *Server) resetUserMFA(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := findManagedUser(s.dbFor(c).Select("id"), getAuthContext(c), id, &user); err != nil {
+		respondUserError(c, err, "failed to fetch user")
+		return
+	}
+
+	if err := clearMFA(s.dbFor(c), user.ID); err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to reset two-factor authentication")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) startMFASetup(c *gin.Context, user *models.User) {
+	if user.TOTPEnabledAt != nil {
+		respondError(c, http.StatusConflict, errMFAAlreadyEnabled.Error())
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+
+	if err := s.dbFor(c).Model(user).Update("totp_secret", secret).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to start two-factor setup")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(secret, user.Email),
+	})
+}
+
+func (s *Server) confirmMFASetup(c *gin.Context, user *models.User, code string) ([]string, bool) {
+	if user.TOTPEnabledAt != nil {
+		respondError(c, http.StatusConflict, errMFAAlreadyEnabled.Error())
+		return nil, false
+	}
+	if user.TOTPSecret == "" {
+		respondError(c, http.StatusConflict, errMFANotPending.Error())
+		return nil, false
+	}
+
+	if wait := s.loginThrottle.wait(mfaThrottleKey(user.ID)); wait > 0 {
+		c.Header("Retry-After", retryAfterSeconds(wait))
+		respondError(c, http.StatusTooManyRequests, "too many attempts")
+		return nil, false
+	}
+
+	step, valid := verifyTOTP(user.TOTPSecret, code, time.Now(), 0)
+	if !valid {
+		s.loginThrottle.fail(mfaThrottleKey(user.ID))
+		respondError(c, http.StatusUnauthorized, errMFAInvalidCode.Error())
+		return nil, false
+	}
+	s.loginThrottle.reset(mfaThrottleKey(user.ID))
+
+	var codes []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled_at": now,
+			"totp_last_step":  step,
+		}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to enable two-factor authentication")
+		return nil, false
+	}
+
+	return codes, true
+}
+
+// checkMFACode verifies a code with the same backoff as logins and writes the
+// error response itself.
+func (s *Server) checkMFACode(c *gin.Context, user *models.User, code string) bool {
+	key := mfaThrottleKey(user.ID)
+	if wait := s.loginThrottle.wait(key); wait > 0 {
+		c.Header("Retry-After", retryAfterSeconds(wait))
+		respondError(c, http.StatusTooManyRequests, "too many attempts")
+		return false
+	}
+
+	if err := s.verifyMFA(c.Request.Context(), user, code); err != nil {
+		switch {
+		case errors.Is(err, errMFAInvalidCode):
+			s.loginThrottle.fail(key)
+			respondError(c, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, errMFANotEnabled):
+			respondError(c, http.StatusConflict, err.Error())
+		default:
+			respondError(c, http.StatusInternalServerError, "failed to verify two-factor code")
+		}
+		return false
+	}
+
+	s.loginThrottle.reset(key)
+	return true
+}
+
+func (s *Server) challengeUser(c *gin.Context, token, purpose string) (*models.User, bool) {
+	claims, err := s.parseChallengeToken(token, purpose)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, errChallengeTokenUsage.Error())
+		return nil, false
+	}
+
+	var user models.User
+	if err := s.dbFor(c).First(&user, claims.UserID).Error; err != nil {
+		respondError(c, http.StatusUnauthorized, errChallengeTokenUsage.Error())
+		return nil, false
+	}
+	if user.DisabledAt != nil {
+		respondError(c, http.StatusForbidden, "account disabled")
+		return nil, false
+	}
+	return &user, true
+}
+
+func (s *Server) currentUser(c *gin.Context) (*models.User, bool) {
+	auth := getAuthContext(c)
+	if auth == nil || auth.UserID == 0 {
+		respondError(c, http.StatusForbidden, errUserTokenRequired.Error())
+		return nil, false
+	}
+
+	var user models.User
+	if err := s.dbFor(c).First(&user, auth.UserID).Error; err != nil {
+		respondUserError(c, err, "failed to fetch user")
+		return nil, false
+	}
+	return &user, true
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		raw, err := newTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(raw[:5] + "-" + raw[5:10])
+		codes = append(codes, code)
+		records = append(records, models.RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashToken(normalizeRecoveryCode(code)),
+		})
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+func clearMFA(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/config"
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	oidcStateCookie  = "bsmart_oidc"
+	oidcCookiePath   = "/api/auth/oidc"
+	oidcStateTTL     = 10 * time.Minute
+	oidcHTTPTimeout  = 10 * time.Second
+	oidcStatePurpose = "oidc_state"
+)
+
+var (
+	errOIDCNoRole        = errors.New("no role mapped for identity")
+	errOIDCEmailRequired = errors.New("identity provider did not return an email")
+	errOIDCEmailInUse    = errors.New("email already registered with another account")
+)
+
+type oidcStateClaims struct {
+	Purpose  string `json:"purpose"`
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+type oidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+}
+
+// oidcClient discovers the provider on first use so the API still starts when
+// the identity provider is unreachable.
+type oidcClient struct {
+	cfg      config.Config
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCClient(cfg config.Config) *oidcClient {
+	if cfg.OIDCIssuerURL == "" {
+		return nil
+	}
+	return &oidcClient{cfg: cfg}
+}
+
+func (o *oidcClient) load(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.oauth != nil {
+		return o.oauth, o.verifier, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, o.cfg.OIDCIssuerURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	scopes := o.cfg.OIDCScopes
+	if !containsString(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	o.oauth = &oauth2.Config{
+		ClientID:     o.cfg.OIDCClientID,
+		ClientSecret: o.cfg.OIDCClientSecret,
+		RedirectURL:  o.cfg.OIDCRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.cfg.OIDCClientID})
+	return o.oauth, o.verifier, nil
+}
+
+func (s *Server) oidcLogin(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), oidcHTTPTimeout)
+	defer cancel()
+
+	oauthCfg, _, err := s.oidc.load(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "oidc provider unavailable", "error", err)
+		respondError(c, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+
+	state, err := randomToken(24)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to start login")
+		return
+	}
+	nonce, err := randomToken(24)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to start login")
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	now := time.Now()
+	cookie, err := s.keys.sign(oidcStateClaims{
+		Purpose:  oidcStatePurpose,
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.cfg.JWTIssuer,
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcStateTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to start login")
+		return
+	}
+
+	s.setOIDCCookie(c, cookie, int(oidcStateTTL.Seconds()))
+	c.Redirect(http.StatusFound, oauthCfg.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)))
+}
+
+func (s *Server) oidcCallback(c *gin.Context) {
+	raw, _ := c.Cookie(oidcStateCookie)
+	s.setOIDCCookie(c, "", -1)
+
+	if errCode := c.Query("error"); errCode != "" {
+		slog.WarnContext(c.Request.Context(), "oidc provider error", "error", errCode, "description", c.Query("error_description"))
+		respondError(c, http.StatusUnauthorized, "sign-in rejected by identity provider")
+		return
+	}
+
+	state, err := s.parseOIDCState(raw)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.State), []byte(c.Query("state"))) != 1 {
+		respondError(c, http.StatusBadRequest, "invalid login state")
+		return
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		respondError(c, http.StatusBadRequest, "missing authorization code")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), oidcHTTPTimeout)
+	defer cancel()
+
+	oauthCfg, verifier, err := s.oidc.load(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "oidc provider unavailable", "error", err)
+		respondError(c, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+
+	token, err := oauthCfg.Exchange(ctx, code, oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		slog.WarnContext(ctx, "oidc code exchange failed", "error", err)
+		respondError(c, http.StatusUnauthorized, "failed to exchange authorization code")
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		respondError(c, http.StatusUnauthorized, "missing id token")
+		return
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(state.Nonce)) != 1 {
+		respondError(c, http.StatusUnauthorized, "invalid id token")
+		return
+	}
+
+	identity, err := s.oidcIdentity(idToken)
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	role, err := s.mapOIDCRole(identity.Groups)
+	if err != nil {
+		if errors.Is(err, errOIDCNoRole) {
+			s.metrics.loginFailed(loginFailureOIDC)
+			slog.WarnContext(c.Request.Context(), "oidc login denied", "subject", identity.Subject, "email", identity.Email, "groups", identity.Groups)
+			respondError(c, http.StatusForbidden, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to fetch role")
+		return
+	}
+
+	user, err := s.provisionOIDCUser(c.Request.Context(), identity, role)
+	if err != nil {
+		if errors.Is(err, errOIDCEmailInUse) {
+			respondError(c, http.StatusConflict, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to provision user")
+		return
+	}
+
+	if user.DisabledAt != nil {
+		respondError(c, http.StatusForbidden, "account disabled")
+		return
+	}
+
+	s.finishLogin(c, user)
+}
+
+func (s *Server) setOIDCCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, oidcCookiePath, "", s.cfg.AppEnv != "development", true)
+}
+
+func (s *Server) parseOIDCState(raw string) (*oidcStateClaims, error) {
+	if raw == "" {
+		return nil, errors.New("missing state cookie")
+	}
+
+	claims := &oidcStateClaims{}
+	token, err := jwt.ParseWithClaims(raw, claims, s.keys.keyFunc,
+		jwt.WithValidMethods(s.keys.validMethods()),
+		jwt.WithIssuer(s.cfg.JWTIssuer),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Purpose != oidcStatePurpose {
+		return nil, errors.New("invalid state cookie")
+	}
+	return claims, nil
+}
+
+func (s *Server) oidcIdentity(idToken *oidc.IDToken) (*oidcIdentity, error) {
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, errOIDCEmailRequired
+	}
+	verified, _ := claims["email_verified"].(bool)
+
+	return &oidcIdentity{
+		Subject:       idToken.Subject,
+		Email:         strings.ToLower(email),
+		EmailVerified: verified,
+		Groups:        claimStrings(claims[s.cfg.OIDCGroupsClaim]),
+	}, nil
+}
+
+// mapOIDCRole returns the role of the first configured mapping whose group
+// the identity belongs to, falling back to OIDC_DEFAULT_ROLE.
+func (s *Server) mapOIDCRole(groups []string) (string, error) {
+	role := s.cfg.OIDCDefaultRole
+	for _, mapping := range s.cfg.OIDCRoleMappings {
+		if containsString(groups, mapping.Group) {
+			role = mapping.Role
+			break
+		}
+	}
+	if role == "" {
+		return "", errOIDCNoRole
+	}
+
+	exists, err := roleExists(s.db, role)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		slog.Error("oidc role mapping points to unknown role", "role", role)
+		return "", errOIDCNoRole
+	}
+	return role, nil
+}
+
+// provisionOIDCUser finds the user by subject, links an existing account
+// with the same (IdP-verified) email on first sign-in, or creates one. The
+// IdP is the source of truth for the role, except that it never takes
+// users:manage from an organization's last manager. A new role ends the
+// user's other sessions, which carry the old one.
+func (s *Server) provisionOIDCUser(ctx context.Context, identity *oidcIdentity, role string) (*models.User, error) {
+	var (
+		user    models.User
+		revoked []string
+	)
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("oidc_subject = ?", identity.Subject).First(&user).Error
+		if errorsIs(err, gorm.ErrRecordNotFound) && identity.EmailVerified {
+			err = tx.Where("LOWER(email) = ?", identity.Email).First(&user).Error
+		}
+
+		switch {
+		case errorsIs(err, gorm.ErrRecordNotFound):
+			hash, err := unusablePasswordHash()
+			if err != nil {
+				return err
+			}
+			user = models.User{
+				Email:        identity.Email,
+				PasswordHash: hash,
+				Role:         role,
+				OIDCSubject:  &identity.Subject,
+			}
+			if identity.EmailVerified {
+				now := time.Now()
+				user.EmailVerifiedAt = &now
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				if errors.Is(err, gorm.ErrDuplicatedKey) {
+					return errOIDCEmailInUse
+				}
+				return err
+			}
+			if err := s.joinOIDCOrganization(tx, user.ID); err != nil {
+				return err
+			}
+			slog.InfoContext(tx.Statement.Context, "oidc user created", "user_id", user.ID, "email", user.Email, "role", role)
+			return nil
+		case err != nil:
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if user.OIDCSubject == nil {
+			updates["oidc_subject"] = identity.Subject
+			user.OIDCSubject = &identity.Subject
+		}
+		if user.EmailVerifiedAt == nil && identity.EmailVerified && strings.EqualFold(user.Email, identity.Email) {
+			now := time.Now()
+			updates["email_verified_at"] = now
+			user.EmailVerifiedAt = &now
+		}
+		if user.Role != role {
+			if err := s.keepsManager(tx, &user, role); err != nil {
+				if !errors.Is(err, errLastAdmin) {
+					return err
+				}
+				slog.WarnContext(tx.Statement.Context, "oidc kept role of last user manager", "user_id", user.ID, "mapped_role", role)
+			} else {
+				updates["role"] = role
+				user.Role = role
+			}
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if _, ok := updates["role"]; !ok {
+			return nil
+		}
+		revoked, err = revokeUserSessions(tx, user.ID, "")
+		return err
+	})
+	if err == nil {
+		s.closeSessions(revoked)
+	}
+
+	return &user, err
+}
+
+// joinOIDCOrganization adds just-in-time users to OIDC_ORGANIZATION so they
+// can sign in; further memberships are managed by an admin.
+func (s *Server) joinOIDCOrganization(tx *gorm.DB, userID uint) error {
+	var org models.Organization
+	if err := tx.Where("slug = ?", s.cfg.OIDCOrganization).First(&org).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			slog.WarnContext(tx.Statement.Context, "OIDC_ORGANIZATION not found, user has no membership", "organization", s.cfg.OIDCOrganization, "user_id", userID)
+			return nil
+		}
+		return err
+	}
+	return tx.Create(&models.Membership{OrganizationID: org.ID, UserID: userID}).Error
+}
+
+// unusablePasswordHash lets SSO-only accounts satisfy the password column
+// without any password that could ever match.
+func unusablePasswordHash() (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return parseClaimList(v)
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				out = append(out, str)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func parseClaimList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+var (
+	errNoMembership = errors.New("user does not belong to any organization")
+	errNotMember    = errors.New("user is not a member of this organization")
+	errInvalidSlug  = errors.New("slug must be lowercase letters, digits and dashes")
+	errUserNotFound = errors.New("user not found")
+	errNoSuchMember = errors.New("membership not found")
+	errAddMember    = errors.New("adding existing users requires " + models.PermPlatformManage)
+)
+
+// managedOrganization reports whether the caller may manage organization id:
+// any of them with platform:manage, otherwise only the current one. Others
+// are answered as not found.
+func managedOrganization(auth *AuthContext, id uint) bool {
+	return auth.Can(models.PermPlatformManage) || id == auth.OrgID
+}
+
+// userOrganization returns orgID when the user belongs to it, or the user's
+// oldest membership when orgID is zero.
+func userOrganization(db *gorm.DB, userID, orgID uint) (*models.Organization, error) {
+	query := db.Model(&models.Organization{}).
+		Joins("JOIN memberships m ON m.organization_id = organizations.id").
+		Where("m.user_id = ?", userID)
+	if orgID != 0 {
+		query = query.Where("organizations.id = ?", orgID)
+	}
+
+	var org models.Organization
+	if err := query.Order("m.created_at asc, organizations.id asc").First(&org).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			if orgID != 0 {
+				return nil, errNotMember
+			}
+			return nil, errNoMembership
+		}
+		return nil, err
+	}
+	return &org, nil
+}
+
+func (s *Server) listMyOrganizations(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var orgs []models.Organization
+	if err := s.dbFor(c).Joins("JOIN memberships m ON m.organization_id = organizations.id").
+		Where("m.user_id = ?", user.ID).
+		Order("organizations.name asc").
+		Find(&orgs).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch organizations")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    orgs,
+		"current": getAuthContext(c).OrgID,
+	})
+}
+
+// listOrganizations lists every organization to platform admins and the
+// caller's own to everyone else.
+func (s *Server) listOrganizations(c *gin.Context) {
+	auth := getAuthContext(c)
+	db := s.dbFor(c)
+	if !auth.Can(models.PermPlatformManage) {
+		db = db.Where("id = ? OR id IN (SELECT organization_id FROM memberships WHERE user_id = ?)", auth.OrgID, auth.UserID)
+	}
+
+	var orgs []models.Organization
+	if err := db.Order("name asc").Find(&orgs).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch organizations")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": orgs})
+}
+
+func (s *Server) createOrganization(c *gin.Context) {
+	var req CreateOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if !slugPattern.MatchString(req.Slug) {
+		respondError(c, http.StatusBadRequest, errInvalidSlug.Error())
+		return
+	}
+
+	org := models.Organization{Name: req.Name, Slug: req.Slug}
+	auth := getAuthContext(c)
+
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		// The creator joins so they can switch to it right away.
+		if auth.UserID == 0 {
+			return nil
+		}
+		return tx.Create(&models.Membership{OrganizationID: org.ID, UserID: auth.UserID}).Error
+	})
+	if err != nil {
+		respondOrganizationError(c, err, "failed to create organization")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": org})
+}
+
+func (s *Server) updateOrganization(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req UpdateOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	if !managedOrganization(getAuthContext(c), id) {
+		respondOrganizationError(c, gorm.ErrRecordNotFound, "failed to fetch organization")
+		return
+	}
+
+	var org models.Organization
+	if err := s.dbFor(c).First(&org, id).Error; err != nil {
+		respondOrganizationError(c, err, "failed to fetch organization")
+		return
+	}
+
+	org.Name = req.Name
+	if err := s.dbFor(c).Save(&org).Error; err != nil {
+		respondOrganizationError(c, err, "failed to update organization")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": org})
+}
+
+func (s *Server) listMembers(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if !managedOrganization(getAuthContext(c), id) {
+		respondOrganizationError(c, gorm.ErrRecordNotFound, "failed to fetch organization")
+		return
+	}
+
+	var org models.Organization
+	if err := s.dbFor(c).Select("id").First(&org, id).Error; err != nil {
+		respondOrganizationError(c, err, "failed to fetch organization")
+		return
+	}
+
+	var users []models.User
+	if err := s.dbFor(c).Joins("JOIN memberships m ON m.user_id = users.id").
+		Where("m.organization_id = ?", id).
+		Order("users.email asc").
+		Find(&users).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch members")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": users})
+}
+
+func (s *Server) addMember(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req AddMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	// The user keeps their other memberships, so this reaches across
+	// organizations; admins of one create users in it instead.
+	if !getAuthContext(c).Can(models.PermPlatformManage) {
+		respondError(c, http.StatusForbidden, errAddMember.Error())
+		return
+	}
+
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id").First(&models.Organization{}, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Select("id").First(&models.User{}, req.UserID).Error; err != nil {
+			if errorsIs(err, gorm.ErrRecordNotFound) {
+				return errUserNotFound
+			}
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.Membership{OrganizationID: id, UserID: req.UserID}).Error
+	})
+	if err != nil {
+		respondOrganizationError(c, err, "failed to add member")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) removeMember(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	if !managedOrganization(getAuthContext(c), id) {
+		respondOrganizationError(c, gorm.ErrRecordNotFound, "failed to fetch organization")
+		return
+	}
+
+	var revoked []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("organization_id = ? AND user_id = ?", id, userID).Delete(&models.Membership{})
+		if err := res.Error; err != nil {
+			return err
+		}
+		if res.RowsAffected == 0 {
+			return errNoSuchMember
+		}
+		// Sessions in that organization end; the next refresh of any other
+		// session picks another membership.
+		var err error
+		revoked, err = revokeSessions(tx, "user_id = ? AND organization_id = ?", userID, id)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND organization_id = ? AND revoked_at IS NULL", userID, id).
+			Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		respondOrganizationError(c, err, "failed to remove member")
+		return
+	}
+	s.closeSessions(revoked)
+
+	c.Status(http.StatusNoContent)
+}
+
+func respondOrganizationError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errorsIs(err, gorm.ErrRecordNotFound):
+		respondError(c, http.StatusNotFound, "organization not found")
+	case errors.Is(err, errUserNotFound), errors.Is(err, errNoSuchMember):
+		respondError(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		respondError(c, http.StatusConflict, "organization slug already exists")
+	case errors.Is(err, errNoMembership), errors.Is(err, errNotMember):
+		respondError(c, http.StatusForbidden, err.Error())
+	default:
+		respondError(c, http.StatusInternalServerError, fallback)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const permissionCacheTTL = 30 * time.Second
+
+type permissionSet map[string]struct{}
+
+func (p permissionSet) has(perm string) bool {
+	_, ok := p[perm]
+	return ok
+}
+
+func (p permissionSet) hasAny(perms []string) bool {
+	for _, perm := range perms {
+		if p.has(perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p permissionSet) list() []string {
+	out := make([]string, 0, len(p))
+	for perm := range p {
+		out = append(out, perm)
+	}
+	return out
+}
+
+// permissionCache keeps the role -> permissions mapping in memory. Local role
+// changes invalidate it immediately; other replicas pick them up after the TTL.
+type permissionCache struct {
+	db       *gorm.DB
+	mu       sync.RWMutex
+	roles    map[string]permissionSet
+	loadedAt time.Time
+}
+
+func newPermissionCache(db *gorm.DB) *permissionCache {
+	return &permissionCache{db: db}
+}
+
+func (p *permissionCache) forRole(role string) (permissionSet, error) {
+	p.mu.RLock()
+	roles, fresh := p.roles, time.Since(p.loadedAt) < permissionCacheTTL
+	p.mu.RUnlock()
+
+	if roles == nil || !fresh {
+		var err error
+		if roles, err = p.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if perms, ok := roles[role]; ok {
+		return perms, nil
+	}
+	return permissionSet{}, nil
+}
+
+func (p *permissionCache) load() (map[string]permissionSet, error) {
+	var records []models.Role
+	if err := p.db.Preload("Permissions").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	roles := make(map[string]permissionSet, len(records))
+	for _, role := range records {
+		perms := make(permissionSet, len(role.Permissions))
+		for _, perm := range role.Permissions {
+			perms[perm.Name] = struct{}{}
+		}
+		roles[role.Name] = perms
+	}
+
+	p.mu.Lock()
+	p.roles = roles
+	p.loadedAt = time.Now()
+	p.mu.Unlock()
+
+	return roles, nil
+}
+
+func (p *permissionCache) invalidate() {
+	p.mu.Lock()
+	p.roles = nil
+	p.mu.Unlock()
+}
@@ -31,7 +31,8 @@ func (s *Server) listProducts(c *gin.Context) {
 	page, pageSize, _ := parsePagination(query.PaginationQuery)
 	order := sanitizeSort(query.Sort, productSortOptions, "created_at desc")
 
-	db := s.db.Model(&models.Product{}).Preload("Categories")
+	orgID := getAuthContext(c).OrgID
+	db := s.dbFor(c).Model(&models.Product{}).Scopes(inTenant("products", orgID)).Preload("Categories")
 
 	if query.CategoryID > 0 {
 		db = db.Joins("JOIN product_categories pc ON pc.product_id = products.id").Where("pc.category_id = ?", query.CategoryID)
@@ -69,7 +70,7 @@ func (s *Server) getProduct(c *gin.Context) {
 	}
 
 	var product models.Product
-	if err := s.db.Preload("Categories").First(&product, id).Error; err != nil {
+	if err := s.dbFor(c).Scopes(inTenant("products", getAuthContext(c).OrgID)).Preload("Categories").First(&product, id).Error; err != nil {
 		if errorsIs(err, gorm.ErrRecordNotFound) {
 			respondError(c, http.StatusNotFound, "product not found")
 			return
@@ -88,16 +89,18 @@ func (s *Server) createProduct(c *gin.Context) {
 		return
 	}
 
+	orgID := getAuthContext(c).OrgID
 	product := models.Product{
-		Name:        req.Name,
-		Description: req.Description,
-		Price:       req.Price,
-		Stock:       req.Stock,
+		OrganizationID: orgID,
+		Name:           req.Name,
+		Description:    req.Description,
+		Price:          req.Price,
+		Stock:          req.Stock,
 	}
 
 	if len(req.CategoryIDs) > 0 {
 		var categories []models.Category
-		if err := s.db.Where("id IN ?", req.CategoryIDs).Find(&categories).Error; err != nil {
+		if err := s.dbFor(c).Scopes(inTenant("categories", orgID)).Where("id IN ?", req.CategoryIDs).Find(&categories).Error; err != nil {
 			respondError(c, http.StatusBadRequest, "invalid categories")
 			return
 		}
@@ -108,20 +111,26 @@ func (s *Server) createProduct(c *gin.Context) {
 		product.Categories = categories
 	}
 
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
 		if err := tx.Create(&product).Error; err != nil {
 			return err
 		}
 		if err := s.recordHistory(tx, product.ID, product.Price, product.Stock); err != nil {
 			return err
 		}
+		if err := enqueueEvent(tx, orgID, productMessage("product.created", product.ID, product)); err != nil {
+			return err
+		}
+		if s.crossedLowStock(0, product.Stock, true) {
+			return enqueueEvent(tx, orgID, stockLowMessage(product))
+		}
 		return nil
 	}); err != nil {
 		respondError(c, http.StatusInternalServerError, "failed to create product")
 		return
 	}
 
-	s.wsHub.Broadcast(NewWSMessage("product.created", product))
+	s.wakeOutbox()
 
 	c.JSON(http.StatusCreated, gin.H{"data": product})
 }
@@ -138,11 +147,21 @@ func (s *Server) updateProduct(c *gin.Context) {
 		return
 	}
 
+	auth := getAuthContext(c)
+
+	// Callers with only products:stock may change nothing but the stock.
+	if !auth.Can(models.PermProductsWrite) {
+		if req.Name != nil || req.Description != nil || req.Price != nil || req.CategoryIDs != nil {
+			respondError(c, http.StatusForbidden, "forbidden")
+			return
+		}
+	}
+
 	var product models.Product
 	originalPrice := 0.0
 	originalStock := 0
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Preload("Categories").First(&product, id).Error; err != nil {
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Scopes(inTenant("products", auth.OrgID)).Preload("Categories").First(&product, id).Error; err != nil {
 			return err
 		}
 
@@ -165,7 +184,7 @@ func (s *Server) updateProduct(c *gin.Context) {
 		if req.CategoryIDs != nil {
 			var categories []models.Category
 			if len(req.CategoryIDs) > 0 {
-				if err := tx.Where("id IN ?", req.CategoryIDs).Find(&categories).Error; err != nil {
+				if err := tx.Scopes(inTenant("categories", auth.OrgID)).Where("id IN ?", req.CategoryIDs).Find(&categories).Error; err != nil {
 					return err
 				}
 				if len(categories) != len(req.CategoryIDs) {
@@ -188,6 +207,12 @@ func (s *Server) updateProduct(c *gin.Context) {
 			}
 		}
 
+		if err := enqueueEvent(tx, auth.OrgID, productMessage("product.updated", product.ID, product)); err != nil {
+			return err
+		}
+		if s.crossedLowStock(originalStock, product.Stock, false) {
+			return enqueueEvent(tx, auth.OrgID, stockLowMessage(product))
+		}
 		return nil
 	})
 
@@ -204,7 +229,7 @@ func (s *Server) updateProduct(c *gin.Context) {
 		return
 	}
 
-	s.wsHub.Broadcast(NewWSMessage("product.updated", product))
+	s.wakeOutbox()
 
 	c.JSON(http.StatusOK, gin.H{"data": product})
 }
@@ -215,19 +240,20 @@ func (s *Server) deleteProduct(c *gin.Context) {
 		return
 	}
 
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Where("product_id = ?", id).Delete(&models.ProductHistory{}).Error; err != nil {
+	orgID := getAuthContext(c).OrgID
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var product models.Product
+		if err := tx.Scopes(inTenant("products", orgID)).Select("id").First(&product, id).Error; err != nil {
 			return err
 		}
 
-		res := tx.Delete(&models.Product{}, id)
-		if err := res.Error; err != nil {
+		if err := tx.Where("product_id = ?", id).Delete(&models.ProductHistory{}).Error; err != nil {
 			return err
 		}
-		if res.RowsAffected == 0 {
-			return gorm.ErrRecordNotFound
+		if err := tx.Delete(&product).Error; err != nil {
+			return err
 		}
-		return nil
+		return enqueueEvent(tx, orgID, productMessage("product.deleted", id, gin.H{"id": id}))
 	})
 
 	if err != nil {
@@ -239,7 +265,7 @@ func (s *Server) deleteProduct(c *gin.Context) {
 		return
 	}
 
-	s.wsHub.Broadcast(NewWSMessage("product.deleted", gin.H{"id": id}))
+	s.wakeOutbox()
 
 	c.Status(http.StatusNoContent)
 }
@@ -251,7 +277,7 @@ func (s *Server) productHistory(c *gin.Context) {
 	}
 
 	var product models.Product
-	if err := s.db.Select("id").First(&product, id).Error; err != nil {
+	if err := s.dbFor(c).Scopes(inTenant("products", getAuthContext(c).OrgID)).Select("id").First(&product, id).Error; err != nil {
 		if errorsIs(err, gorm.ErrRecordNotFound) {
 			respondError(c, http.StatusNotFound, "product not found")
 			return
@@ -266,7 +292,7 @@ func (s *Server) productHistory(c *gin.Context) {
 		return
 	}
 
-	db := s.db.Where("product_id = ?", id)
+	db := s.dbFor(c).Where("product_id = ?", id)
 
 	if !query.Start.IsZero() {
 		db = db.Where("changed_at >= ?", query.Start)
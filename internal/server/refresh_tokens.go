@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// familyID is the ID of the session the token belongs to.
+func (s *Server) issueRefreshToken(db *gorm.DB, userID, orgID uint, familyID string) (string, *models.RefreshToken, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	record := models.RefreshToken{
+		UserID:         userID,
+		OrganizationID: orgID,
+		FamilyID:       familyID,
+		TokenHash:      hashToken(raw),
+		ExpiresAt:      time.Now().Add(s.refreshTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", nil, err
+	}
+	return raw, &record, nil
+}
+
+type rotatedToken struct {
+	token     string
+	sessionID string
+	user      *models.User
+	org       *models.Organization
+}
+
+// rotateRefreshToken keeps the token's organization unless orgID asks to
+// switch to another one the user belongs to. If the user has left the current
+// organization, the session moves to another membership.
+func (s *Server) rotateRefreshToken(c *gin.Context, raw string, orgID uint) (*rotatedToken, error) {
+	var (
+		result  rotatedToken
+		revoked []string
+	)
+
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var current models.RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashToken(raw)).
+			First(&current).Error; err != nil {
+			if errorsIs(err, gorm.ErrRecordNotFound) {
+				return errRefreshTokenInvalid
+			}
+			return err
+		}
+
+		if current.RevokedAt != nil {
+			// A rotated token presented again means it leaked: end the session.
+			var err error
+			revoked, err = revokeSessions(tx, "id = ?", current.FamilyID)
+			if err != nil {
+				return err
+			}
+			return revokeRefreshFamily(tx, current.FamilyID)
+		}
+
+		if time.Now().After(current.ExpiresAt) {
+			return errRefreshTokenExpired
+		}
+
+		var user models.User
+		if err := tx.First(&user, current.UserID).Error; err != nil {
+			if errorsIs(err, gorm.ErrRecordNotFound) {
+				return errRefreshTokenInvalid
+			}
+			return err
+		}
+		if user.DisabledAt != nil {
+			return errRefreshTokenInvalid
+		}
+
+		requested := orgID
+		if requested == 0 {
+			requested = current.OrganizationID
+		}
+		org, err := userOrganization(tx, user.ID, requested)
+		if errors.Is(err, errNotMember) && orgID == 0 {
+			org, err = userOrganization(tx, user.ID, 0)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.touchSession(tx, c, &current, org.ID); err != nil {
+			return err
+		}
+
+		token, replacement, err := s.issueRefreshToken(tx, current.UserID, org.ID, current.FamilyID)
+		if err != nil {
+			return err
+		}
+
+		result = rotatedToken{token: token, sessionID: current.FamilyID, user: &user, org: org}
+		return tx.Model(&current).Updates(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"replaced_by_id": replacement.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if revoked != nil || result.token == "" {
+		s.closeSessions(revoked)
+		return nil, errRefreshTokenReused
+	}
+	return &result, nil
+}
+
+// touchSession extends the session behind a refresh token. Families issued
+// before sessions existed get one on their first rotation.
+func (s *Server) touchSession(tx *gorm.DB, c *gin.Context, current *models.RefreshToken, orgID uint) error {
+	var session models.Session
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", current.FamilyID).First(&session).Error
+	if errorsIs(err, gorm.ErrRecordNotFound) {
+		_, err = s.createSession(tx, c, current.FamilyID, current.UserID, orgID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if session.RevokedAt != nil {
+		return errSessionRevoked
+	}
+
+	now := time.Now()
+	return tx.Model(&session).Updates(map[string]interface{}{
+		"organization_id": orgID,
+		"expires_at":      now.Add(s.refreshTTL),
+		"last_seen_at":    now,
+	}).Error
+}
+
+// revokeRefreshToken ends the session the token belongs to and returns it
+// for closeSessions.
+func (s *Server) revokeRefreshToken(raw string) ([]string, error) {
+	var current models.RefreshToken
+	if err := s.db.Where("token_hash = ?", hashToken(raw)).First(&current).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ids []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		ids, err = revokeSessions(tx, "id = ?", current.FamilyID)
+		if err != nil {
+			return err
+		}
+		return revokeRefreshFamily(tx, current.FamilyID)
+	})
+	return ids, err
+}
+
+func revokeRefreshFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+var (
+	errUnknownPermissions = errors.New("some permissions not found")
+	errRoleImmutable      = errors.New("built-in admin role permissions cannot be modified")
+	errRoleSystem         = errors.New("system roles cannot be deleted")
+	errRoleInUse          = errors.New("role is assigned to users")
+	errRoleShared         = errors.New("shared roles can only be changed with " + models.PermPlatformManage)
+)
+
+// visibleRoles limits a roles query to the shared roles and those of the
+// caller's organization, unless the caller has platform:manage.
+func visibleRoles(db *gorm.DB, auth *AuthContext) *gorm.DB {
+	if auth.Can(models.PermPlatformManage) {
+		return db
+	}
+	return db.Where("roles.organization_id IS NULL OR roles.organization_id = ?", auth.OrgID)
+}
+
+// findEditableRole loads a role the caller may change. Shared roles apply
+// to every organization, so they need platform:manage.
+func findEditableRole(db *gorm.DB, auth *AuthContext, id uint, role *models.Role) error {
+	if err := visibleRoles(db, auth).First(role, id).Error; err != nil {
+		return err
+	}
+	if role.OrganizationID == nil && !auth.Can(models.PermPlatformManage) {
+		return errRoleShared
+	}
+	return nil
+}
+
+func (s *Server) listPermissions(c *gin.Context) {
+	var perms []models.Permission
+	if err := s.dbFor(c).Order("name asc").Find(&perms).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch permissions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": perms})
+}
+
+func (s *Server) listRoles(c *gin.Context) {
+	var roles []models.Role
+	if err := visibleRoles(s.dbFor(c), getAuthContext(c)).Preload("Permissions").Order("name asc").Find(&roles).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch roles")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": roles})
+}
+
+func (s *Server) createRole(c *gin.Context) {
+	var req CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	role := models.Role{
+		Name:        req.Name,
+		Description: req.Description,
+		RequireMFA:  req.RequireMFA,
+	}
+	// Platform admins create shared roles; everyone else, their organization's.
+	if auth := getAuthContext(c); !auth.Can(models.PermPlatformManage) {
+		role.OrganizationID = &auth.OrgID
+	}
+
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := checkPermissionGrant(getAuthContext(c), req.Permissions); err != nil {
+			return err
+		}
+		perms, err := findPermissions(tx, req.Permissions)
+		if err != nil {
+			return err
+		}
+		role.Permissions = perms
+		return tx.Create(&role).Error
+	})
+	if err != nil {
+		respondRoleError(c, err, "failed to create role")
+		return
+	}
+
+	s.permissions.invalidate()
+
+	c.JSON(http.StatusCreated, gin.H{"data": role})
+}
+
+func (s *Server) updateRole(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	var role models.Role
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := findEditableRole(tx.Preload("Permissions"), getAuthContext(c), id, &role); err != nil {
+			return err
+		}
+		if (role.Name == models.RoleAdmin || role.Name == models.RolePlatform) && (req.Description != nil || req.Permissions != nil) {
+			return errRoleImmutable
+		}
+
+		if req.Description != nil {
+			role.Description = *req.Description
+		}
+		if req.RequireMFA != nil {
+			role.RequireMFA = *req.RequireMFA
+		}
+
+		if req.Permissions != nil {
+			if err := checkPermissionGrant(getAuthContext(c), req.Permissions); err != nil {
+				return err
+			}
+			perms, err := findPermissions(tx, req.Permissions)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&role).Association("Permissions").Replace(perms); err != nil {
+				return err
+			}
+			role.Permissions = perms
+		}
+
+		return tx.Omit("Permissions").Save(&role).Error
+	})
+	if err != nil {
+		respondRoleError(c, err, "failed to update role")
+		return
+	}
+
+	s.permissions.invalidate()
+
+	c.JSON(http.StatusOK, gin.H{"data": role})
+}
+
+func (s *Server) deleteRole(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var role models.Role
+		if err := findEditableRole(tx, getAuthContext(c), id, &role); err != nil {
+			return err
+		}
+		if role.System {
+			return errRoleSystem
+		}
+
+		var assigned int64
+		if err := tx.Model(&models.User{}).Where("role = ?", role.Name).Count(&assigned).Error; err != nil {
+			return err
+		}
+		if assigned > 0 {
+			return errRoleInUse
+		}
+
+		if err := tx.Model(&role).Association("Permissions").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&role).Error
+	})
+	if err != nil {
+		respondRoleError(c, err, "failed to delete role")
+		return
+	}
+
+	s.permissions.invalidate()
+
+	c.Status(http.StatusNoContent)
+}
+
+// checkPermissionGrant keeps callers without platform:manage from putting it
+// in a role.
+func checkPermissionGrant(auth *AuthContext, names []string) error {
+	if auth.Can(models.PermPlatformManage) {
+		return nil
+	}
+	for _, name := range names {
+		if name == models.PermPlatformManage {
+			return errGrantPlatform
+		}
+	}
+	return nil
+}
+
+func findPermissions(db *gorm.DB, names []string) ([]models.Permission, error) {
+	unique := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		unique[name] = struct{}{}
+	}
+	if len(unique) == 0 {
+		return []models.Permission{}, nil
+	}
+
+	keys := make([]string, 0, len(unique))
+	for name := range unique {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+
+	var perms []models.Permission
+	if err := db.Where("name IN ?", keys).Find(&perms).Error; err != nil {
+		return nil, err
+	}
+	if len(perms) != len(keys) {
+		return nil, errUnknownPermissions
+	}
+	return perms, nil
+}
+
+// roleAssignable reports whether the caller may give users the role: a
+// shared one or one of their organization's.
+func roleAssignable(db *gorm.DB, auth *AuthContext, name string) (bool, error) {
+	return roleExists(visibleRoles(db, auth), name)
+}
+
+func roleExists(db *gorm.DB, name string) (bool, error) {
+	var count int64
+	if err := db.Model(&models.Role{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func respondRoleError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errorsIs(err, gorm.ErrRecordNotFound):
+		respondError(c, http.StatusNotFound, "role not found")
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		respondError(c, http.StatusConflict, "role already exists")
+	case errors.Is(err, errUnknownPermissions):
+		respondError(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRoleImmutable), errors.Is(err, errRoleSystem), errors.Is(err, errRoleInUse):
+		respondError(c, http.StatusConflict, err.Error())
+	case errors.Is(err, errGrantPlatform), errors.Is(err, errRoleShared):
+		respondError(c, http.StatusForbidden, err.Error())
+	default:
+		respondError(c, http.StatusInternalServerError, fallback)
+	}
+}
@@ -15,10 +15,20 @@ func (s *Server) search(c *gin.Context) {
 		return
 	}
 
+	auth := getAuthContext(c)
+
 	switch query.Type {
 	case "product":
+		if !auth.Can(models.PermProductsRead) {
+			respondError(c, http.StatusForbidden, "forbidden")
+			return
+		}
 		s.searchProducts(c, query)
 	case "category":
+		if !auth.Can(models.PermCategoriesRead) {
+			respondError(c, http.StatusForbidden, "forbidden")
+			return
+		}
 		s.searchCategories(c, query)
 	default:
 		respondError(c, http.StatusBadRequest, "unsupported search type")
@@ -29,7 +39,7 @@ func (s *Server) searchProducts(c *gin.Context, query SearchQuery) {
 	page, pageSize, _ := parsePagination(query.PaginationQuery)
 	order := sanitizeSort(query.Sort, productSortOptions, "created_at desc")
 
-	db := s.db.Model(&models.Product{}).Preload("Categories")
+	db := s.dbFor(c).Model(&models.Product{}).Scopes(inTenant("products", getAuthContext(c).OrgID)).Preload("Categories")
 
 	if query.Query != "" {
 		like := "%" + query.Query + "%"
@@ -59,7 +69,7 @@ func (s *Server) searchProducts(c *gin.Context, query SearchQuery) {
 func (s *Server) searchCategories(c *gin.Context, query SearchQuery) {
 	order := sanitizeSort(query.Sort, categorySortOptions, "created_at desc")
 
-	db := s.db.Model(&models.Category{})
+	db := s.dbFor(c).Model(&models.Category{}).Scopes(inTenant("categories", getAuthContext(c).OrgID))
 	if query.Query != "" {
 		like := "%" + query.Query + "%"
 		db = db.Where("name ILIKE ? OR description ILIKE ?", like, like)
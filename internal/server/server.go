@@ -1,45 +1,107 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"gorm.io/gorm"
 
 	"github.com/ignimbrite/bsmart-challenge/internal/config"
+	"github.com/ignimbrite/bsmart-challenge/internal/eventbus"
+	"github.com/ignimbrite/bsmart-challenge/internal/mailer"
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
 )
 
+const readHeaderTimeout = 10 * time.Second
+
 type Server struct {
 	cfg            config.Config
 	db             *gorm.DB
 	engine         *gin.Engine
-	tokenSecret    []byte
+	http           *http.Server
+	keys           *KeySet
 	tokenTTL       time.Duration
+	refreshTTL     time.Duration
 	wsHub          *Hub
+	bus            eventbus.Bus
+	outboxWake     chan struct{}
+	webhookClient  *http.Client
+	webhookWake    chan struct{}
+	permissions    *permissionCache
+	sessions       *sessionCache
+	loginThrottle  *loginThrottle
+	oidc           *oidcClient
+	mailer         mailer.Mailer
+	metrics        *metrics
 	allowedOrigins []string
+
+	// ctx is cancelled on shutdown to stop the background tasks, which
+	// tasks tracks together with in-flight mail.
+	ctx   context.Context
+	stop  context.CancelFunc
+	tasks sync.WaitGroup
 }
 
-func New(cfg config.Config, db *gorm.DB, tokenSecret []byte, tokenTTL time.Duration) *Server {
+func New(cfg config.Config, db *gorm.DB, keys *KeySet, mail mailer.Mailer, bus eventbus.Bus, tokenTTL, refreshTTL time.Duration) *Server {
 	gin.SetMode(gin.ReleaseMode)
 
-	engine := gin.New()
-	engine.Use(gin.Logger(), gin.Recovery())
-
 	hub := NewHub()
-	go hub.Run()
+	metrics := newMetrics(db, hub)
+
+	engine := gin.New()
+	// ClientIP (login throttling, sessions, access log) only believes
+	// X-Forwarded-For from TRUSTED_PROXIES; with none it is the socket's.
+	if err := engine.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		slog.Error("invalid TRUSTED_PROXIES, trusting none", "error", err)
+		_ = engine.SetTrustedProxies(nil)
+	}
+	engine.Use(
+		otelgin.Middleware(cfg.ServiceName, otelgin.WithGinFilter(traceRequest)),
+		requestIDMiddleware(),
+		accessLogMiddleware(),
+		metrics.middleware(),
+		recoveryMiddleware(),
+	)
 
 	srv := &Server{
 		cfg:            cfg,
 		db:             db,
 		engine:         engine,
-		tokenSecret:    tokenSecret,
+		keys:           keys,
 		tokenTTL:       tokenTTL,
+		refreshTTL:     refreshTTL,
 		wsHub:          hub,
+		bus:            bus,
+		outboxWake:     make(chan struct{}, 1),
+		webhookClient:  newWebhookClient(cfg.WebhookTimeout, cfg.WebhookAllowPrivate),
+		webhookWake:    make(chan struct{}, 1),
+		permissions:    newPermissionCache(db),
+		sessions:       newSessionCache(db),
+		loginThrottle:  newLoginThrottle(cfg.LoginBackoffBase, cfg.LoginBackoffMax),
+		oidc:           newOIDCClient(cfg),
+		mailer:         mail,
+		metrics:        metrics,
 		allowedOrigins: cfg.WSAllowed,
 	}
+	srv.ctx, srv.stop = context.WithCancel(context.Background())
+	srv.http = &http.Server{
+		Addr:              fmt.Sprintf(":%s", cfg.HTTPPort),
+		Handler:           engine,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	srv.background(srv.runEventBus)
+	srv.background(srv.runOutbox)
+	srv.background(srv.compactEvents)
+	srv.background(srv.runWebhooks)
 
 	engine.Use(corsMiddleware(srv.allowedOrigins))
 	srv.registerRoutes()
@@ -52,37 +114,165 @@ func (s *Server) registerRoutes() {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	s.engine.GET("/.well-known/jwks.json", s.serveJWKS)
+
+	if s.metricsEnabled() {
+		s.engine.GET("/metrics", s.metricsHandler())
+	}
+
 	s.engine.StaticFS("/web", gin.Dir("docs", false))
 	s.engine.StaticFS("/docs", gin.Dir("docs", false))
 
-	s.engine.GET("/ws", s.authMiddleware("admin", "client"), s.handleWebSocket)
+	s.engine.GET("/ws", s.wsAuthMiddleware(), s.handleWebSocket)
 
 	api := s.engine.Group("/api")
 
 	api.POST("/auth/login", s.login)
+	api.POST("/auth/refresh", s.refresh)
+	api.POST("/auth/logout", s.logout)
+	api.POST("/auth/2fa/verify", s.verifyMFALogin)
+	api.POST("/auth/2fa/enroll", s.enrollMFALogin)
+	api.POST("/auth/password/forgot", s.forgotPassword)
+	api.POST("/auth/password/reset", s.resetPassword)
+	api.POST("/auth/email/verify", s.verifyEmail)
+	if s.oidc != nil {
+		api.GET("/auth/oidc/login", s.oidcLogin)
+		api.GET("/auth/oidc/callback", s.oidcCallback)
+	}
+
+	me := api.Group("/me")
+	me.Use(s.authMiddleware())
+	me.GET("/organizations", s.listMyOrganizations)
+	me.GET("/sessions", s.listSessions)
+	me.DELETE("/sessions", s.revokeOtherSessions)
+	me.DELETE("/sessions/:id", s.revokeSession)
+	me.PUT("/password", s.changePassword)
+	me.POST("/email/verification", s.requestEmailVerification)
+	me.POST("/2fa/setup", s.setupMFA)
+	me.POST("/2fa/enable", s.enableMFA)
+	me.POST("/2fa/disable", s.disableMFA)
+	me.POST("/2fa/recovery-codes", s.regenerateRecoveryCodes)
+
+	api.GET("/products", s.authMiddleware(models.PermProductsRead), s.listProducts)
+	api.GET("/products/:id", s.authMiddleware(models.PermProductsRead), s.getProduct)
+	api.GET("/products/:id/history", s.authMiddleware(models.PermHistoryRead), s.productHistory)
+	api.POST("/products", s.authMiddleware(models.PermProductsWrite), s.createProduct)
+	api.PUT("/products/:id", s.authMiddleware(models.PermProductsWrite, models.PermProductsStock), s.updateProduct)
+	api.DELETE("/products/:id", s.authMiddleware(models.PermProductsDelete), s.deleteProduct)
+
+	api.GET("/categories", s.authMiddleware(models.PermCategoriesRead), s.listCategories)
+	api.POST("/categories", s.authMiddleware(models.PermCategoriesWrite), s.createCategory)
+	api.PUT("/categories/:id", s.authMiddleware(models.PermCategoriesWrite), s.updateCategory)
+	api.DELETE("/categories/:id", s.authMiddleware(models.PermCategoriesDelete), s.deleteCategory)
+
+	api.POST("/ws/ticket", s.authMiddleware(models.PermWSSubscribe), s.issueWSTicket)
+	api.GET("/events", s.wsAuthMiddleware(), s.streamEvents)
+
+	api.GET("/search", s.authMiddleware(models.PermProductsRead, models.PermCategoriesRead), s.search)
 
-	protected := api.Group("/")
-	protected.Use(s.authMiddleware("admin", "client"))
-	protected.GET("/products", s.listProducts)
-	protected.GET("/products/:id", s.getProduct)
-	protected.GET("/products/:id/history", s.productHistory)
-	protected.GET("/categories", s.listCategories)
-	protected.GET("/search", s.search)
-
-	admin := api.Group("/")
-	admin.Use(s.authMiddleware("admin"))
-	admin.POST("/products", s.createProduct)
-	admin.PUT("/products/:id", s.updateProduct)
-	admin.DELETE("/products/:id", s.deleteProduct)
-
-	admin.POST("/categories", s.createCategory)
-	admin.PUT("/categories/:id", s.updateCategory)
-	admin.DELETE("/categories/:id", s.deleteCategory)
+	users := api.Group("/users")
+	users.Use(s.authMiddleware(models.PermUsersManage))
+	users.GET("", s.listUsers)
+	users.POST("", s.createUser)
+	users.PUT("/:id/role", s.updateUserRole)
+	users.PUT("/:id/password", s.resetUserPassword)
+	users.POST("/:id/disable", s.disableUser)
+	users.POST("/:id/enable", s.enableUser)
+	users.POST("/:id/unlock", s.unlockUser)
+	users.POST("/:id/2fa/reset", s.resetUserMFA)
+	users.POST("/:id/logout", s.logoutUser)
+	users.DELETE("/:id", s.deleteUser)
+
+	roles := api.Group("/")
+	roles.Use(s.authMiddleware(models.PermRolesManage))
+	roles.GET("/permissions", s.listPermissions)
+	roles.GET("/roles", s.listRoles)
+	roles.POST("/roles", s.createRole)
+	roles.PUT("/roles/:id", s.updateRole)
+	roles.DELETE("/roles/:id", s.deleteRole)
+
+	orgs := api.Group("/organizations")
+	orgs.Use(s.authMiddleware(models.PermOrgsManage))
+	orgs.GET("", s.listOrganizations)
+	orgs.POST("", s.createOrganization)
+	orgs.PUT("/:id", s.updateOrganization)
+	orgs.GET("/:id/members", s.listMembers)
+	orgs.POST("/:id/members", s.addMember)
+	orgs.DELETE("/:id/members/:user_id", s.removeMember)
+
+	apiKeys := api.Group("/api-keys")
+	apiKeys.Use(s.authMiddleware(models.PermAPIKeysManage))
+	apiKeys.GET("", s.listAPIKeys)
+	apiKeys.POST("", s.createAPIKey)
+	apiKeys.DELETE("/:id", s.revokeAPIKey)
+
+	webhooks := api.Group("/webhooks")
+	webhooks.Use(s.authMiddleware(models.PermWebhooksManage))
+	webhooks.GET("", s.listWebhooks)
+	webhooks.POST("", s.createWebhook)
+	webhooks.PUT("/:id", s.updateWebhook)
+	webhooks.DELETE("/:id", s.deleteWebhook)
+	webhooks.GET("/:id/deliveries", s.listWebhookDeliveries)
+	webhooks.POST("/:id/deliveries/:delivery_id/replay", s.replayWebhookDelivery)
 }
 
+// Run serves HTTP until Shutdown is called, which makes it return nil.
 func (s *Server) Run() error {
-	address := fmt.Sprintf(":%s", s.cfg.HTTPPort)
-	return s.engine.Run(address)
+	if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown sends a going-away close to every WebSocket/SSE client, waits for
+// in-flight requests, then stops the background tasks after they flush the
+// outbox and finish the webhooks and mail already being sent. The database
+// is left open for the caller to close. Whatever is unfinished when ctx ends
+// is abandoned: committed outbox events and pending webhook deliveries are
+// picked up again on the next start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	hubErr := s.wsHub.Shutdown(ctx)
+	httpErr := s.http.Shutdown(ctx)
+
+	s.stop()
+	done := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		close(done)
+	}()
+
+	var taskErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		taskErr = fmt.Errorf("background tasks: %w", ctx.Err())
+	}
+	return errors.Join(hubErr, httpErr, taskErr)
+}
+
+// background runs fn as a task Shutdown waits for.
+func (s *Server) background(fn func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		fn()
+	}()
+}
+
+// traceRequest leaves out of tracing the probes and the WebSocket and SSE
+// streams, whose request lasts as long as the connection; their broadcasts
+// are traced on their own.
+func traceRequest(c *gin.Context) bool {
+	switch c.FullPath() {
+	case "/health", "/metrics", "/ws", "/api/events":
+		return false
+	}
+	return true
+}
+
+// dbFor scopes queries to the request, so they are logged with its ID.
+func (s *Server) dbFor(c *gin.Context) *gorm.DB {
+	return s.db.WithContext(c.Request.Context())
 }
 
 func (s *Server) Engine() *gin.Engine {
@@ -124,11 +314,12 @@ func corsMiddleware(allowed []string) gin.HandlerFunc {
 				c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 			}
 			c.Writer.Header().Set("Vary", "Origin")
+			c.Writer.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
 		}
 		if allowOrigin || c.Request.Method == http.MethodOptions {
 			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
-			c.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,Accept,ngrok-skip-browser-warning")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,Accept,X-API-Key,Last-Event-ID,X-Request-ID,traceparent,tracestate,ngrok-skip-browser-warning")
 		}
 		if c.Request.Method == http.MethodOptions {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	sessionCacheTTL     = 15 * time.Second
+	sessionLastSeenStep = time.Minute
+	userAgentMaxLength  = 255
+)
+
+var (
+	errSessionRevoked  = errors.New("session revoked")
+	errSessionNotFound = errors.New("session not found")
+)
+
+type sessionEntry struct {
+	userID    uint
+	active    bool
+	lastSeen  time.Time
+	checkedAt time.Time
+}
+
+// sessionCache remembers whether a session is still active so authMiddleware
+// does not hit the database on every request. Revocations on this replica
+// take effect at once; other replicas notice within sessionCacheTTL.
+type sessionCache struct {
+	db        *gorm.DB
+	mu        sync.Mutex
+	entries   map[string]sessionEntry
+	lastPrune time.Time
+	// generation changes on every invalidation, so a read that overlapped
+	// one is not cached over it.
+	generation uint64
+}
+
+func newSessionCache(db *gorm.DB) *sessionCache {
+	return &sessionCache{db: db, entries: make(map[string]sessionEntry)}
+}
+
+func (s *sessionCache) check(sessionID string, userID uint) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	entry, ok := s.entries[sessionID]
+	generation := s.generation
+	s.mu.Unlock()
+
+	if !ok || now.Sub(entry.checkedAt) > sessionCacheTTL {
+		var session models.Session
+		err := s.db.Select("id", "user_id", "expires_at", "last_seen_at", "revoked_at").
+			Where("id = ?", sessionID).First(&session).Error
+		if err != nil && !errorsIs(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		entry = sessionEntry{
+			userID:    session.UserID,
+			active:    err == nil && session.RevokedAt == nil && now.Before(session.ExpiresAt),
+			lastSeen:  session.LastSeenAt,
+			checkedAt: now,
+		}
+		s.store(sessionID, entry, generation, now)
+	}
+
+	if !entry.active || entry.userID != userID {
+		return errSessionRevoked
+	}
+
+	if s.touch(sessionID, now) {
+		return s.db.Model(&models.Session{}).Where("id = ?", sessionID).Update("last_seen_at", now).Error
+	}
+	return nil
+}
+
+// touch reports whether the session's last_seen_at is due an update and, if
+// so, marks it seen so concurrent requests do not write it too.
+func (s *sessionCache) touch(sessionID string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[sessionID]
+	if !ok || now.Sub(entry.lastSeen) <= sessionLastSeenStep {
+		return false
+	}
+	entry.lastSeen = now
+	s.entries[sessionID] = entry
+	return true
+}
+
+func (s *sessionCache) store(sessionID string, entry sessionEntry, generation uint64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return
+	}
+	s.entries[sessionID] = entry
+	if now.Sub(s.lastPrune) > time.Minute {
+		for id, e := range s.entries {
+			if now.Sub(e.checkedAt) > sessionCacheTTL {
+				delete(s.entries, id)
+			}
+		}
+		s.lastPrune = now
+	}
+}
+
+func (s *sessionCache) invalidate(sessionIDs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range sessionIDs {
+		delete(s.entries, id)
+	}
+	s.generation++
+}
+
+// createSession records a login. An empty id starts a new session; refresh
+// families from before sessions existed pass their own.
+func (s *Server) createSession(tx *gorm.DB, c *gin.Context, id string, userID, orgID uint) (*models.Session, error) {
+	if id == "" {
+		var err error
+		if id, err = randomToken(16); err != nil {
+			return nil, err
+		}
+	}
+
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > userAgentMaxLength {
+		userAgent = userAgent[:userAgentMaxLength]
+	}
+
+	now := time.Now()
+	session := models.Session{
+		ID:             id,
+		UserID:         userID,
+		OrganizationID: orgID,
+		UserAgent:      userAgent,
+		IP:             c.ClientIP(),
+		ExpiresAt:      now.Add(s.refreshTTL),
+		LastSeenAt:     now,
+	}
+	if err := tx.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// revokeSessions ends every active session matching the condition together
+// with its refresh tokens, and returns their IDs for closeSessions.
+func revokeSessions(tx *gorm.DB, query string, args ...interface{}) ([]string, error) {
+	var ids []string
+	if err := tx.Model(&models.Session{}).
+		Where("revoked_at IS NULL").
+		Where(query, args...).
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if err := tx.Model(&models.Session{}).Where("id IN ?", ids).Update("revoked_at", now).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&models.RefreshToken{}).
+		Where("family_id IN ? AND revoked_at IS NULL", ids).
+		Update("revoked_at", now).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// revokeUserSessions signs the user out everywhere except keep, which may be
+// empty. Refresh tokens older than sessions are revoked too.
+func revokeUserSessions(tx *gorm.DB, userID uint, keep string) ([]string, error) {
+	ids, err := revokeSessions(tx, "user_id = ? AND id <> ?", userID, keep)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keep).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// closeSessions must run after the revoking transaction commits.
+func (s *Server) closeSessions(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	s.sessions.invalidate(ids)
+	s.wsHub.Disconnect(ids)
+}
+
+func (s *Server) listSessions(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var sessions []models.Session
+	if err := s.dbFor(c).Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch sessions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    sessions,
+		"current": getAuthContext(c).SessionID,
+	})
+}
+
+func (s *Server) revokeSession(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var ids []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		ids, err = revokeSessions(tx, "id = ? AND user_id = ?", c.Param("id"), user.ID)
+		if err == nil && len(ids) == 0 {
+			return errSessionNotFound
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			respondError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to revoke session")
+		return
+	}
+	s.closeSessions(ids)
+
+	c.Status(http.StatusNoContent)
+}
+
+// revokeOtherSessions signs the user out everywhere except this session.
+func (s *Server) revokeOtherSessions(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var ids []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		ids, err = revokeUserSessions(tx, user.ID, getAuthContext(c).SessionID)
+		return err
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to revoke sessions")
+		return
+	}
+	s.closeSessions(ids)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) logoutUser(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var ids []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := findManagedUser(tx.Select("id"), getAuthContext(c), id, &models.User{}); err != nil {
+			return err
+		}
+		var err error
+		ids, err = revokeUserSessions(tx, id, "")
+		return err
+	})
+	if err != nil {
+		respondUserError(c, err, "failed to revoke sessions")
+		return
+	}
+	s.closeSessions(ids)
+
+	c.JSON(http.StatusOK, gin.H{"revoked": len(ids)})
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sseHeartbeat = 15 * time.Second
+	sseRetry     = 3 * time.Second
+)
+
+// sseStream writes hub messages as Server-Sent Events. Only writePump
+// touches it.
+type sseStream struct {
+	w gin.ResponseWriter
+}
+
+// event sends the message as `data` in the same JSON shape as /ws, with the
+// sequence number as the event id so EventSource resumes via Last-Event-ID.
+func (s *sseStream) event(msg WSMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if msg.Seq != 0 {
+		if _, err := fmt.Fprintf(s.w, "id: %d\n", msg.Seq); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", msg.Event, data); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+func (s *sseStream) comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+// streamEvents is the Server-Sent Events twin of /ws: same auth, topics,
+// replay and close reasons, without client frames. Change topics by
+// reconnecting.
+func (s *Server) streamEvents(c *gin.Context) {
+	since := c.GetHeader("Last-Event-ID")
+	if since == "" {
+		since = c.Query("since")
+	}
+
+	client, err := s.newClient(c, since)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	client.stream = &sseStream{w: c.Writer}
+	client.gone = c.Request.Context().Done()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	if _, err := fmt.Fprintf(c.Writer, "retry: %s\n\n", strconv.FormatInt(sseRetry.Milliseconds(), 10)); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	s.wsHub.register(client)
+	defer s.wsHub.unregister(client)
+
+	client.writePump()
+}
@@ -59,3 +59,107 @@ type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
 }
+
+type RefreshRequest struct {
+	RefreshToken   string `json:"refresh_token" binding:"required"`
+	OrganizationID uint   `json:"organization_id"`
+}
+
+type UserQuery struct {
+	PaginationQuery
+	Role string `form:"role"`
+}
+
+type CreateUserRequest struct {
+	Email    string `json:"email" binding:"required,email,max=255"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+	Role     string `json:"role" binding:"required,max=50"`
+	// Defaults to the caller's current organization.
+	OrganizationIDs []uint `json:"organization_ids" binding:"omitempty,dive,gt=0"`
+}
+
+type UpdateUserRoleRequest struct {
+	Role string `json:"role" binding:"required,max=50"`
+}
+
+type ResetPasswordRequest struct {
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type PasswordResetRequest struct {
+	Token    string `json:"token" binding:"required,max=128"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8,max=72"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required,max=128"`
+}
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name" binding:"required,min=2,max=255"`
+	Slug string `json:"slug" binding:"required,min=2,max=100"`
+}
+
+type UpdateOrganizationRequest struct {
+	Name string `json:"name" binding:"required,min=2,max=255"`
+}
+
+type AddMemberRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+type CreateRoleRequest struct {
+	Name        string   `json:"name" binding:"required,min=2,max=50"`
+	Description string   `json:"description" binding:"omitempty,max=1000"`
+	Permissions []string `json:"permissions" binding:"required"`
+	RequireMFA  bool     `json:"require_mfa"`
+}
+
+type UpdateRoleRequest struct {
+	Description *string  `json:"description" binding:"omitempty,max=1000"`
+	Permissions []string `json:"permissions"`
+	RequireMFA  *bool    `json:"require_mfa"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string    `json:"name" binding:"required,min=2,max=255"`
+	Scopes    []string  `json:"scopes" binding:"required,min=1"`
+	ExpiresAt time.Time `json:"expires_at" binding:"required"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required,max=32"`
+}
+
+type MFAChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"omitempty,max=32"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url,max=2048"`
+	Events []string `json:"events" binding:"required,min=1"`
+	Secret string   `json:"secret" binding:"omitempty,min=16,max=128"`
+	Active *bool    `json:"active"`
+}
+
+type UpdateWebhookRequest struct {
+	URL    string   `json:"url" binding:"omitempty,url,max=2048"`
+	Events []string `json:"events" binding:"omitempty,min=1"`
+	Secret string   `json:"secret" binding:"omitempty,min=16,max=128"`
+	Active *bool    `json:"active"`
+}
+
+type WebhookDeliveryQuery struct {
+	PaginationQuery
+	Status string `form:"status" binding:"omitempty,oneof=pending succeeded failed"`
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+var userSortOptions = map[string]string{
+	"email_asc":  "email asc",
+	"email_desc": "email desc",
+	"newest":     "created_at desc",
+	"oldest":     "created_at asc",
+}
+
+var (
+	errLastAdmin   = errors.New("cannot remove the last user manager of an organization")
+	errUnknownRole = errors.New("unknown role")
+
+	errUnknownOrganizations = errors.New("some organizations not found")
+	errOtherOrganization    = errors.New("users can only be added to the current organization")
+	errGrantPlatform        = errors.New("only platform admins can grant " + models.PermPlatformManage)
+)
+
+// rolesWith selects the names of the roles that carry a permission.
+const rolesWith = `SELECT r.name FROM roles r
+	JOIN role_permissions rp ON rp.role_id = r.id
+	JOIN permissions p ON p.id = rp.permission_id
+	WHERE p.name = ?`
+
+// orgUsers limits a users query to the members of the caller's organization,
+// unless the caller has platform:manage.
+func orgUsers(db *gorm.DB, auth *AuthContext) *gorm.DB {
+	if auth.Can(models.PermPlatformManage) {
+		return db
+	}
+	return db.Where("EXISTS (SELECT 1 FROM memberships m WHERE m.user_id = users.id AND m.organization_id = ?)", auth.OrgID)
+}
+
+// managedUsers limits a users query to the ones the caller may change. A
+// password, a role or a disabled flag applies in every organization of the
+// user, so without platform:manage that is only users who belong to the
+// caller's organization and no other, and who are not platform admins.
+func managedUsers(db *gorm.DB, auth *AuthContext) *gorm.DB {
+	if auth.Can(models.PermPlatformManage) {
+		return db
+	}
+	return orgUsers(db, auth).
+		Where("NOT EXISTS (SELECT 1 FROM memberships m WHERE m.user_id = users.id AND m.organization_id <> ?)", auth.OrgID).
+		Where("users.role NOT IN ("+rolesWith+")", models.PermPlatformManage)
+}
+
+// findManagedUser loads the user the caller may change, or ErrRecordNotFound.
+func findManagedUser(db *gorm.DB, auth *AuthContext, id uint, user *models.User) error {
+	return managedUsers(db, auth).First(user, id).Error
+}
+
+// checkRoleGrant keeps callers without platform:manage from handing out a
+// role that has it.
+func (s *Server) checkRoleGrant(auth *AuthContext, role string) error {
+	if auth.Can(models.PermPlatformManage) {
+		return nil
+	}
+	perms, err := s.permissions.forRole(role)
+	if err != nil {
+		return err
+	}
+	if perms.has(models.PermPlatformManage) {
+		return errGrantPlatform
+	}
+	return nil
+}
+
+func (s *Server) listUsers(c *gin.Context) {
+	var query UserQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid query params")
+		return
+	}
+
+	page, pageSize, _ := parsePagination(query.PaginationQuery)
+	order := sanitizeSort(query.Sort, userSortOptions, "created_at desc")
+
+	db := orgUsers(s.dbFor(c).Model(&models.User{}), getAuthContext(c))
+
+	if query.Role != "" {
+		db = db.Where("role = ?", query.Role)
+	}
+
+	if query.Query != "" {
+		db = db.Where("email ILIKE ?", "%"+query.Query+"%")
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to count users")
+		return
+	}
+
+	var users []models.User
+	if err := db.Order(order).Limit(pageSize).Offset((page - 1) * pageSize).Find(&users).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch users")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      users,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+func (s *Server) createUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	auth := getAuthContext(c)
+	if exists, err := roleAssignable(s.dbFor(c), auth, req.Role); err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch role")
+		return
+	} else if !exists {
+		respondError(c, http.StatusBadRequest, errUnknownRole.Error())
+		return
+	}
+	if err := s.checkRoleGrant(auth, req.Role); err != nil {
+		respondUserError(c, err, "failed to fetch role")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+
+	user := models.User{
+		Email:        req.Email,
+		PasswordHash: string(hash),
+		Role:         req.Role,
+	}
+
+	orgIDs := req.OrganizationIDs
+	if len(orgIDs) == 0 {
+		orgIDs = []uint{auth.OrgID}
+	}
+	if !auth.Can(models.PermPlatformManage) {
+		for _, orgID := range orgIDs {
+			if orgID != auth.OrgID {
+				respondError(c, http.StatusForbidden, errOtherOrganization.Error())
+				return
+			}
+		}
+	}
+
+	err = s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Organization{}).Where("id IN ?", orgIDs).Count(&count).Error; err != nil {
+			return err
+		}
+		if int(count) != len(uniqueIDs(orgIDs)) {
+			return errUnknownOrganizations
+		}
+
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		memberships := make([]models.Membership, 0, len(orgIDs))
+		for _, orgID := range uniqueIDs(orgIDs) {
+			memberships = append(memberships, models.Membership{OrganizationID: orgID, UserID: user.ID})
+		}
+		return tx.Create(&memberships).Error
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrDuplicatedKey):
+			respondError(c, http.StatusConflict, "email already registered")
+		case errors.Is(err, errUnknownOrganizations):
+			respondError(c, http.StatusBadRequest, err.Error())
+		default:
+			respondError(c, http.StatusInternalServerError, "failed to create user")
+		}
+		return
+	}
+
+	if err := s.sendEmailVerification(c.Request.Context(), &user); err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to issue verification token", "user_id", user.ID, "error", err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"data": user})
+}
+
+func (s *Server) updateUserRole(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req UpdateUserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	auth := getAuthContext(c)
+	var (
+		user    models.User
+		revoked []string
+	)
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := findManagedUser(tx, auth, id, &user); err != nil {
+			return err
+		}
+		if exists, err := roleAssignable(tx, auth, req.Role); err != nil {
+			return err
+		} else if !exists {
+			return errUnknownRole
+		}
+		if err := s.checkRoleGrant(auth, req.Role); err != nil {
+			return err
+		}
+		if user.Role == req.Role {
+			return nil
+		}
+		if err := s.keepsManager(tx, &user, req.Role); err != nil {
+			return err
+		}
+		user.Role = req.Role
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		// Tokens carry the role, so the user signs in again to get the new one.
+		var err error
+		revoked, err = revokeUserSessions(tx, user.ID, "")
+		return err
+	})
+	if err != nil {
+		respondUserError(c, err, "failed to update user")
+		return
+	}
+	s.closeSessions(revoked)
+
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+func (s *Server) resetUserPassword(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to hash password")
+		return
+	}
+
+	var revoked []string
+	err = s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := findManagedUser(tx.Select("id"), getAuthContext(c), id, &models.User{}); err != nil {
+			return err
+		}
+		var err error
+		revoked, err = setPassword(tx, id, string(hash), "")
+		return err
+	})
+	if err != nil {
+		respondUserError(c, err, "failed to reset password")
+		return
+	}
+	s.closeSessions(revoked)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) disableUser(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var (
+		user    models.User
+		revoked []string
+	)
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		if err := findManagedUser(tx, getAuthContext(c), id, &user); err != nil {
+			return err
+		}
+		if user.DisabledAt != nil {
+			return nil
+		}
+		if err := ensureOtherManager(tx, &user); err != nil {
+			return err
+		}
+		now := time.Now()
+		user.DisabledAt = &now
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		var err error
+		revoked, err = revokeUserSessions(tx, user.ID, "")
+		return err
+	})
+	if err != nil {
+		respondUserError(c, err, "failed to disable user")
+		return
+	}
+	s.closeSessions(revoked)
+
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+func (s *Server) enableUser(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := findManagedUser(s.dbFor(c), getAuthContext(c), id, &user); err != nil {
+		respondUserError(c, err, "failed to fetch user")
+		return
+	}
+
+	user.DisabledAt = nil
+	if err := s.dbFor(c).Save(&user).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to enable user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+func (s *Server) unlockUser(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := findManagedUser(s.dbFor(c), getAuthContext(c), id, &user); err != nil {
+		respondUserError(c, err, "failed to fetch user")
+		return
+	}
+
+	if err := s.clearFailedLogins(c.Request.Context(), &user); err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to unlock user")
+		return
+	}
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	s.loginThrottle.reset(emailThrottleKey(user.Email))
+
+	slog.InfoContext(c.Request.Context(), "account unlocked", "user_id", user.ID, "by_user_id", getAuthContext(c).UserID)
+
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+func (s *Server) deleteUser(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var sessionIDs []string
+	err := s.dbFor(c).Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := findManagedUser(tx, getAuthContext(c), id, &user); err != nil {
+			return err
+		}
+		if err := ensureOtherManager(tx, &user); err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Session{}).Where("user_id = ?", user.ID).Pluck("id", &sessionIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.UserToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Membership{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		respondUserError(c, err, "failed to delete user")
+		return
+	}
+	s.closeSessions(sessionIDs)
+
+	c.Status(http.StatusNoContent)
+}
+
+// ensureOtherManager keeps every organization of a user who holds
+// users:manage with another active member who does, before the user loses
+// it. It locks those members so concurrent changes cannot both pass.
+func ensureOtherManager(tx *gorm.DB, user *models.User) error {
+	if user.DisabledAt != nil {
+		return nil
+	}
+
+	var manages int64
+	if err := tx.Model(&models.Role{}).
+		Where("name = ? AND name IN ("+rolesWith+")", user.Role, models.PermUsersManage).
+		Count(&manages).Error; err != nil {
+		return err
+	}
+	if manages == 0 {
+		return nil
+	}
+
+	var orgIDs []uint
+	if err := tx.Model(&models.Membership{}).Where("user_id = ?", user.ID).Pluck("organization_id", &orgIDs).Error; err != nil {
+		return err
+	}
+	if len(orgIDs) == 0 {
+		return nil
+	}
+
+	var managed []uint
+	if err := tx.Raw(`SELECT m.organization_id FROM users u
+		JOIN memberships m ON m.user_id = u.id
+		WHERE m.organization_id IN ? AND u.id <> ? AND u.disabled_at IS NULL AND u.role IN (`+rolesWith+`)
+		FOR UPDATE OF u`,
+		orgIDs, user.ID, models.PermUsersManage,
+	).Scan(&managed).Error; err != nil {
+		return err
+	}
+
+	covered := make(map[uint]bool, len(managed))
+	for _, orgID := range managed {
+		covered[orgID] = true
+	}
+	for _, orgID := range orgIDs {
+		if !covered[orgID] {
+			return errLastAdmin
+		}
+	}
+	return nil
+}
+
+// keepsManager checks ensureOtherManager when the user's new role does not
+// grant users:manage.
+func (s *Server) keepsManager(tx *gorm.DB, user *models.User, role string) error {
+	perms, err := s.permissions.forRole(role)
+	if err != nil {
+		return err
+	}
+	if perms.has(models.PermUsersManage) {
+		return nil
+	}
+	return ensureOtherManager(tx, user)
+}
+
+func respondUserError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errorsIs(err, gorm.ErrRecordNotFound):
+		respondError(c, http.StatusNotFound, "user not found")
+	case errors.Is(err, errLastAdmin):
+		respondError(c, http.StatusConflict, err.Error())
+	case errors.Is(err, errUnknownRole):
+		respondError(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errGrantPlatform):
+		respondError(c, http.StatusForbidden, err.Error())
+	default:
+		respondError(c, http.StatusInternalServerError, fallback)
+	}
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]struct{}, len(ids))
+	out := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+	return out
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const (
+	webhookPollEvery  = 5 * time.Second
+	webhookBatchSize  = 20
+	webhookRetryFirst = 30 * time.Second
+	webhookRetryMax   = time.Hour
+	// At most this much of a response is read, only so the connection can be
+	// reused; it is not kept.
+	webhookResponseLimit = 1024
+	// A claimed delivery whose worker died is retried once its lease is over.
+	webhookLease = time.Minute
+)
+
+var (
+	errWebhookDisabled = errors.New("webhook is disabled")
+	errWebhookAddress  = errors.New("webhook address is not public")
+)
+
+// sharedAddressSpace is the carrier-grade NAT range, as internal as RFC 1918.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// signWebhook returns the X-Bsmart-Signature value: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the wait after the given failed attempt: 30s, 1m, 2m…
+// up to an hour.
+func webhookBackoff(attempt int) time.Duration {
+	wait := webhookRetryFirst
+	for i := 1; i < attempt && wait < webhookRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > webhookRetryMax {
+		wait = webhookRetryMax
+	}
+	return wait
+}
+
+// publicWebhookAddr reports whether a webhook may connect to addr: not
+// loopback, private, link-local (cloud metadata lives there) or otherwise
+// internal.
+func publicWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() && !addr.IsMulticast() &&
+		!addr.IsUnspecified() && !sharedAddressSpace.Contains(addr)
+}
+
+// webhookDialControl vets the address actually being connected to, after
+// DNS resolution, so neither a name resolving to an internal IP nor DNS
+// rebinding reaches the internal network.
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicWebhookAddr(addr) {
+		return fmt.Errorf("%w: %s", errWebhookAddress, host)
+	}
+	return nil
+}
+
+// newWebhookClient does not follow redirects: a receiver answering 3xx has
+// not accepted the delivery. Unless allowPrivate is set it only connects to
+// public addresses, and goes direct: behind a proxy the check would only see
+// the proxy.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !allowPrivate {
+		dialer.Control = webhookDialControl
+		transport.Proxy = nil
+	}
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (s *Server) wakeWebhooks() {
+	select {
+	case s.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// runWebhooks sends due deliveries, polling so retries and deliveries queued
+// by other replicas are picked up too. On shutdown it returns after the batch
+// in flight; the rest stays queued.
+func (s *Server) runWebhooks() {
+	ticker := time.NewTicker(webhookPollEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.webhookWake:
+		case <-s.ctx.Done():
+			return
+		}
+
+		for s.ctx.Err() == nil {
+			claimed, err := s.dispatchWebhooks()
+			if err != nil {
+				slog.Error("webhook dispatch failed", "error", err)
+			}
+			if claimed < webhookBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// dispatchWebhooks claims a batch of due deliveries and sends them. SKIP
+// LOCKED keeps replicas from claiming the same rows, and the lease pushes
+// next_attempt_at forward so a crash mid-send only delays the retry.
+func (s *Server) dispatchWebhooks() (int, error) {
+	now := time.Now()
+	var deliveries []models.WebhookDelivery
+	if err := s.db.Raw(`UPDATE webhook_deliveries
+		SET attempts = attempts + 1, last_attempt_at = ?, next_attempt_at = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		now, now.Add(s.cfg.WebhookTimeout+webhookLease), now,
+		models.DeliveryPending, now, webhookBatchSize,
+	).Scan(&deliveries).Error; err != nil {
+		return 0, err
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]uint, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.WebhookID)
+	}
+	var hooks []models.Webhook
+	if err := s.db.Where("id IN ?", ids).Find(&hooks).Error; err != nil {
+		return len(deliveries), err
+	}
+	byID := make(map[uint]models.Webhook, len(hooks))
+	for _, hook := range hooks {
+		byID[hook.ID] = hook
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		hook, ok := byID[delivery.WebhookID]
+		if !ok || !hook.Active {
+			s.finishDelivery(delivery, 0, errWebhookDisabled, true)
+			continue
+		}
+
+		wg.Add(1)
+		go func(hook models.Webhook, delivery models.WebhookDelivery) {
+			defer wg.Done()
+			status, err := s.sendWebhook(hook, delivery)
+			s.finishDelivery(delivery, status, err, delivery.Attempts >= s.cfg.WebhookMaxAttempts)
+		}(hook, delivery)
+	}
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+func (s *Server) sendWebhook(hook models.Webhook, delivery models.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(gin.H{
+		"id":              delivery.ID,
+		"event":           delivery.Event,
+		"seq":             delivery.EventSeq,
+		"organization_id": delivery.OrganizationID,
+		"created_at":      delivery.CreatedAt,
+		"data":            json.RawMessage(delivery.Payload),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bsmart-webhooks")
+	req.Header.Set("X-Bsmart-Event", delivery.Event)
+	req.Header.Set("X-Bsmart-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Bsmart-Timestamp", timestamp)
+	req.Header.Set("X-Bsmart-Signature", signWebhook(hook.Secret, timestamp, body))
+
+	res, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, webhookResponseLimit))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// finishDelivery records an attempt; a failed one is scheduled again unless
+// final.
+func (s *Server) finishDelivery(delivery models.WebhookDelivery, status int, sendErr error, final bool) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"response_status": status,
+		"updated_at":      now,
+	}
+	switch {
+	case sendErr == nil:
+		updates["status"] = models.DeliverySucceeded
+		updates["delivered_at"] = now
+		updates["last_error"] = ""
+	case final:
+		updates["status"] = models.DeliveryFailed
+		updates["last_error"] = sendErr.Error()
+	default:
+		updates["next_attempt_at"] = now.Add(webhookBackoff(delivery.Attempts))
+		updates["last_error"] = sendErr.Error()
+	}
+
+	if err := s.db.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error; err != nil {
+		slog.Error("failed to record webhook delivery", "delivery_id", delivery.ID, "error", err)
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const webhookSecretPrefix = "whsec_"
+
+// webhookEvents are the events a webhook can subscribe to; "product.*",
+// "category.*" and "*" match several of them.
+var webhookEvents = map[string]struct{}{
+	"product.created":  {},
+	"product.updated":  {},
+	"product.deleted":  {},
+	"category.created": {},
+	"category.updated": {},
+	"category.deleted": {},
+	topicStockLow:      {},
+	"product.*":        {},
+	"category.*":       {},
+	"*":                {},
+}
+
+var deliverySortOptions = map[string]string{
+	"newest": "created_at desc",
+	"oldest": "created_at asc",
+}
+
+// webhookDeliveryView shows the stored payload as JSON rather than bytes.
+type webhookDeliveryView struct {
+	models.WebhookDelivery
+	Payload json.RawMessage
+}
+
+func newDeliveryView(delivery models.WebhookDelivery) webhookDeliveryView {
+	return webhookDeliveryView{WebhookDelivery: delivery, Payload: json.RawMessage(delivery.Payload)}
+}
+
+func webhookMatches(patterns []string, event string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == event {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(events))
+	normalized := make([]string, 0, len(events))
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if _, ok := webhookEvents[event]; !ok {
+			return nil, fmt.Errorf("invalid event %q", event)
+		}
+		if _, ok := seen[event]; ok {
+			continue
+		}
+		seen[event] = struct{}{}
+		normalized = append(normalized, event)
+	}
+	return normalized, nil
+}
+
+// validWebhookURL also turns away hosts that could never be dialed unless
+// allowPrivate is set: localhost and literal non-public IPs. Names that
+// resolve to such IPs are stopped when dialing.
+func validWebhookURL(raw string, allowPrivate bool) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if allowPrivate {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !publicWebhookAddr(addr) {
+		return false
+	}
+	return true
+}
+
+// enqueueWebhooks queues a delivery of the event for every active webhook of
+// its organization that listens to it. It runs in the transaction that stores
+// the event, so both are kept or lost together.
+func enqueueWebhooks(tx *gorm.DB, event models.Event) (int, error) {
+	var hooks []models.Webhook
+	if err := tx.Where("organization_id = ? AND active", event.OrganizationID).Find(&hooks).Error; err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var deliveries []models.WebhookDelivery
+	for _, hook := range hooks {
+		if !webhookMatches(hook.Events, event.Type) {
+			continue
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			WebhookID:      hook.ID,
+			OrganizationID: event.OrganizationID,
+			EventSeq:       event.Seq,
+			Event:          event.Type,
+			Payload:        event.Payload,
+			Status:         models.DeliveryPending,
+			NextAttemptAt:  now,
+		})
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+	return len(deliveries), tx.Create(&deliveries).Error
+}
+
+func (s *Server) findWebhook(c *gin.Context) (*models.Webhook, bool) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return nil, false
+	}
+
+	var hook models.Webhook
+	if err := s.dbFor(c).Scopes(inTenant("webhooks", getAuthContext(c).OrgID)).First(&hook, id).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			respondError(c, http.StatusNotFound, "webhook not found")
+			return nil, false
+		}
+		respondError(c, http.StatusInternalServerError, "failed to fetch webhook")
+		return nil, false
+	}
+	return &hook, true
+}
+
+func (s *Server) listWebhooks(c *gin.Context) {
+	var hooks []models.Webhook
+	if err := s.dbFor(c).Scopes(inTenant("webhooks", getAuthContext(c).OrgID)).
+		Order("created_at desc").Find(&hooks).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch webhooks")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": hooks})
+}
+
+func (s *Server) createWebhook(c *gin.Context) {
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	if !validWebhookURL(req.URL, s.cfg.WebhookAllowPrivate) {
+		respondError(c, http.StatusBadRequest, "url must be a public http or https address")
+		return
+	}
+	events, err := normalizeWebhookEvents(req.Events)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		raw, err := randomToken(32)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, "failed to generate secret")
+			return
+		}
+		secret = webhookSecretPrefix + raw
+	}
+
+	auth := getAuthContext(c)
+	hook := models.Webhook{
+		OrganizationID: auth.OrgID,
+		URL:            req.URL,
+		Events:         events,
+		Secret:         secret,
+		Active:         req.Active == nil || *req.Active,
+		CreatedByID:    auth.UserID,
+	}
+	if err := s.dbFor(c).Create(&hook).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to create webhook")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data":   hook,
+		"secret": secret,
+	})
+}
+
+func (s *Server) updateWebhook(c *gin.Context) {
+	var req UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	hook, ok := s.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	if req.URL != "" {
+		if !validWebhookURL(req.URL, s.cfg.WebhookAllowPrivate) {
+			respondError(c, http.StatusBadRequest, "url must be a public http or https address")
+			return
+		}
+		hook.URL = req.URL
+	}
+	if req.Events != nil {
+		events, err := normalizeWebhookEvents(req.Events)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		hook.Events = events
+	}
+	if req.Secret != "" {
+		hook.Secret = req.Secret
+	}
+	if req.Active != nil {
+		hook.Active = *req.Active
+	}
+
+	if err := s.dbFor(c).Save(hook).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to update webhook")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": hook})
+}
+
+func (s *Server) deleteWebhook(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	res := s.dbFor(c).Scopes(inTenant("webhooks", getAuthContext(c).OrgID)).Delete(&models.Webhook{}, id)
+	if err := res.Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+
+	if res.RowsAffected == 0 {
+		respondError(c, http.StatusNotFound, "webhook not found")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) listWebhookDeliveries(c *gin.Context) {
+	var query WebhookDeliveryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		respondError(c, http.StatusBadRequest, "invalid query params")
+		return
+	}
+
+	hook, ok := s.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	page, pageSize, _ := parsePagination(query.PaginationQuery)
+	order := sanitizeSort(query.Sort, deliverySortOptions, "created_at desc")
+
+	db := s.dbFor(c).Model(&models.WebhookDelivery{}).Where("webhook_id = ?", hook.ID)
+	if query.Status != "" {
+		db = db.Where("status = ?", query.Status)
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to count deliveries")
+		return
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := db.Order(order).Limit(pageSize).Offset((page - 1) * pageSize).Find(&deliveries).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to fetch deliveries")
+		return
+	}
+
+	views := make([]webhookDeliveryView, len(deliveries))
+	for i, delivery := range deliveries {
+		views[i] = newDeliveryView(delivery)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      views,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// replayWebhookDelivery queues a new delivery of the same event; the original
+// stays in the log untouched.
+func (s *Server) replayWebhookDelivery(c *gin.Context) {
+	hook, ok := s.findWebhook(c)
+	if !ok {
+		return
+	}
+	deliveryID, ok := parseUintParam(c, "delivery_id")
+	if !ok {
+		return
+	}
+
+	if !hook.Active {
+		respondError(c, http.StatusConflict, "webhook is disabled")
+		return
+	}
+
+	var original models.WebhookDelivery
+	if err := s.dbFor(c).Where("webhook_id = ?", hook.ID).First(&original, deliveryID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			respondError(c, http.StatusNotFound, "delivery not found")
+			return
+		}
+		respondError(c, http.StatusInternalServerError, "failed to fetch delivery")
+		return
+	}
+
+	delivery := models.WebhookDelivery{
+		WebhookID:      hook.ID,
+		OrganizationID: hook.OrganizationID,
+		EventSeq:       original.EventSeq,
+		Event:          original.Event,
+		Payload:        original.Payload,
+		Status:         models.DeliveryPending,
+		NextAttemptAt:  time.Now(),
+		ReplayOfID:     &original.ID,
+	}
+	if err := s.dbFor(c).Create(&delivery).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to replay delivery")
+		return
+	}
+	s.wakeWebhooks()
+
+	c.JSON(http.StatusAccepted, gin.H{"data": newDeliveryView(delivery)})
+}
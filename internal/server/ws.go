@@ -1,83 +1,232 @@
 package server
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	writeWait      = 10 * time.Second
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	maxMessageSize = 4096
 )
 
+var tracer = otel.Tracer("github.com/ignimbrite/bsmart-challenge/internal/server")
+
 type WSMessage struct {
 	Event string      `json:"event"`
 	Data  interface{} `json:"data"`
+	Seq   uint64      `json:"seq,omitempty"`
+	// RequestID is the X-Request-ID of the request that caused the event.
+	RequestID string `json:"request_id,omitempty"`
+	// Topics route the message; clients get it when subscribed to any of
+	// them. A message without topics reaches every client of the tenant.
+	Topics []string `json:"-"`
 }
 
 func NewWSMessage(event string, data interface{}) WSMessage {
 	return WSMessage{Event: event, Data: data}
 }
 
+// Client is a subscriber of the hub, over a WebSocket (conn) or a
+// Server-Sent Events stream (stream).
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan WSMessage
+	hub    *Hub
+	srv    *Server
+	conn   *websocket.Conn
+	stream *sseStream
+	// gone is closed when the peer leaves; SSE only, WebSockets notice on read.
+	gone <-chan struct{}
+	// queue carries hub events and is closed by the hub; replies carries
+	// answers to client frames and is never closed.
+	queue   *sendQueue
+	replies chan WSMessage
+	done    chan struct{}
+	since   uint64
+
+	mu     sync.RWMutex
+	auth   *AuthContext
+	topics map[string]struct{}
+}
+
+func (c *Client) authContext() *AuthContext {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.auth
+}
+
+func (c *Client) setAuth(auth *AuthContext) {
+	c.mu.Lock()
+	c.auth = auth
+	c.mu.Unlock()
 }
 
+func (c *Client) reply(msg WSMessage) {
+	select {
+	case c.replies <- msg:
+	case <-c.done:
+	}
+}
+
+// Hub routes events to the clients of their organization. Broadcast only
+// appends to the clients' queues, so it never waits on a slow client.
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan WSMessage
-	register   chan *Client
-	unregister chan *Client
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+	closed  bool
+	// active counts registered clients, for Shutdown to wait on.
+	active sync.WaitGroup
+
+	dropped      atomic.Uint64
+	coalesced    atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// HubStats are the hub's gauges and counters since start.
+type HubStats struct {
+	Clients      int
+	Dropped      uint64
+	Coalesced    uint64
+	Disconnected uint64
 }
 
 func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan WSMessage),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+	return &Hub{clients: make(map[*Client]struct{})}
+}
+
+func (h *Hub) register(client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		client.queue.close(websocket.CloseGoingAway, "server shutting down")
+		return
 	}
+	h.clients[client] = struct{}{}
+	h.active.Add(1)
 }
 
-func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
-		case msg := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- msg:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
+func (h *Hub) unregister(client *Client) {
+	h.mu.Lock()
+	if _, ok := h.clients[client]; ok {
+		delete(h.clients, client)
+		h.active.Done()
+	}
+	h.mu.Unlock()
+	client.queue.close(0, "")
+}
+
+// Shutdown closes every connection with a going-away frame (a close event
+// on SSE) and waits for them to end.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	for client := range h.clients {
+		client.queue.close(websocket.CloseGoingAway, "server shutting down")
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("hub: %w", ctx.Err())
+	}
+}
+
+// Broadcast records a span as a child of the span in ctx, when there is one.
+func (h *Hub) Broadcast(ctx context.Context, orgID uint, msg WSMessage) {
+	_, span := tracer.Start(ctx, "hub.broadcast "+msg.Event,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("event.type", msg.Event),
+			attribute.Int64("event.seq", int64(msg.Seq)),
+			attribute.Int64("organization.id", int64(orgID)),
+		))
+	defer span.End()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var recipients, dropped int
+	for client := range h.clients {
+		if client.authContext().OrgID != orgID || !client.subscribedToAny(msg.Topics) {
+			continue
+		}
+		recipients++
+		switch client.queue.push(msg) {
+		case pushDroppedOldest:
+			h.dropped.Add(1)
+			dropped++
+		case pushCoalesced:
+			h.coalesced.Add(1)
+			dropped++
+		case pushDisconnected:
+			h.disconnected.Add(1)
+			dropped++
 		}
 	}
+	span.SetAttributes(
+		attribute.Int("hub.clients", len(h.clients)),
+		attribute.Int("hub.recipients", recipients),
+		attribute.Int("hub.dropped", dropped),
+	)
 }
 
-func (h *Hub) Broadcast(msg WSMessage) {
-	h.broadcast <- msg
+// Disconnect closes the connections opened by the given sessions.
+func (h *Hub) Disconnect(sessionIDs []string) {
+	ended := make(map[string]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		ended[id] = true
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for client := range h.clients {
+		if ended[client.authContext().SessionID] {
+			client.queue.close(wsCloseRevoked, "session revoked")
+		}
+	}
+}
+
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	clients := len(h.clients)
+	h.mu.RUnlock()
+
+	return HubStats{
+		Clients:      clients,
+		Dropped:      h.dropped.Load(),
+		Coalesced:    h.coalesced.Load(),
+		Disconnected: h.disconnected.Load(),
+	}
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.unregister(c)
 		c.conn.Close()
 	}()
 
@@ -89,40 +238,132 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		if _, _, err := c.conn.ReadMessage(); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("ws unexpected close: %v", err)
+				slog.Info("ws unexpected close", "error", err)
 			}
 			break
 		}
+
+		var frame WSClientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			c.reply(wsError("", "invalid frame"))
+			continue
+		}
+		c.handleFrame(frame)
 	}
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	heartbeat := time.NewTicker(c.heartbeatPeriod())
+	revalidate := time.NewTicker(pingPeriod)
+	expiry := time.NewTimer(time.Until(c.authContext().ExpiresAt))
 	defer func() {
-		ticker.Stop()
-		c.conn.Close()
+		heartbeat.Stop()
+		revalidate.Stop()
+		expiry.Stop()
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
 	}()
 
+	// The client is registered before the replay, so events published in
+	// between arrive both ways; lastSeq drops the duplicates.
+	var lastSeq uint64
+	if c.since > 0 {
+		var err error
+		if lastSeq, err = c.replay(c.since); err != nil {
+			slog.Error("ws replay failed", "error", err)
+			return
+		}
+	}
+
 	for {
 		select {
-		case msg, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-c.queue.ready:
+			batch := c.queue.take()
+			if batch.dropped > 0 {
+				if err := c.write(laggedMessage(batch.dropped, c.queue.policy)); err != nil {
+					return
+				}
+			}
+			for _, msg := range batch.items {
+				if msg.Seq != 0 && msg.Seq <= lastSeq {
+					continue
+				}
+				if err := c.write(msg); err != nil {
+					return
+				}
+			}
+			if batch.closed {
+				c.writeClose(batch.closeCode, batch.closeText)
 				return
 			}
-			if err := c.conn.WriteJSON(msg); err != nil {
+		case msg := <-c.replies:
+			if err := c.write(msg); err != nil {
+				return
+			}
+		case <-expiry.C:
+			// A fresh token may have moved the deadline since the timer was set.
+			if left := time.Until(c.authContext().ExpiresAt); left > 0 {
+				expiry.Reset(left)
+				continue
+			}
+			c.writeClose(wsCloseTokenExpired, "token expired")
+			return
+		case <-revalidate.C:
+			if code, text := c.srv.revalidateClient(c); code != 0 {
+				c.writeClose(code, text)
 				return
 			}
-		case <-ticker.C:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+		case <-heartbeat.C:
+			if err := c.ping(); err != nil {
 				return
 			}
+		case <-c.gone:
+			return
+		}
+	}
+}
+
+func (c *Client) heartbeatPeriod() time.Duration {
+	if c.stream != nil {
+		return sseHeartbeat
+	}
+	return pingPeriod
+}
+
+func (c *Client) write(msg WSMessage) error {
+	if c.stream != nil {
+		return c.stream.event(msg)
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *Client) ping() error {
+	if c.stream != nil {
+		return c.stream.comment("ping")
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (c *Client) writeClose(code int, text string) {
+	if c.stream != nil {
+		if code != 0 {
+			_ = c.stream.event(NewWSMessage("close", gin.H{"code": code, "reason": text}))
 		}
+		return
 	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if code == 0 {
+		_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		return
+	}
+	_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
 }
 
 func (s *Server) handleWebSocket(c *gin.Context) {
@@ -132,23 +373,59 @@ func (s *Server) handleWebSocket(c *gin.Context) {
 		CheckOrigin:     s.checkOrigin,
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	client, err := s.newClient(c, c.Query("since"))
 	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	client := &Client{
-		hub:  s.wsHub,
-		conn: conn,
-		send: make(chan WSMessage, 16),
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
 	}
+	client.conn = conn
 
-	s.wsHub.register <- client
+	s.wsHub.register(client)
 
 	go client.writePump()
 	client.readPump()
 }
 
+// newClient reads the ?topics=, ?backpressure= and resume position shared by
+// /ws and /api/events.
+func (s *Server) newClient(c *gin.Context, since string) (*Client, error) {
+	raw, present := c.GetQuery("topics")
+	topics, err := parseTopics(raw, present)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := c.DefaultQuery("backpressure", s.cfg.WSBackpressure)
+	if !validBackpressure(policy) {
+		return nil, errors.New("invalid backpressure")
+	}
+
+	client := &Client{
+		hub:     s.wsHub,
+		srv:     s,
+		queue:   newSendQueue(s.cfg.WSSendBuffer, policy),
+		replies: make(chan WSMessage, 4),
+		done:    make(chan struct{}),
+		auth:    getAuthContext(c),
+		topics:  make(map[string]struct{}, len(topics)),
+	}
+	for _, topic := range topics {
+		client.topics[topic] = struct{}{}
+	}
+
+	if since != "" {
+		if client.since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return nil, errors.New("invalid since")
+		}
+	}
+	return client, nil
+}
+
 func (s *Server) checkOrigin(r *http.Request) bool {
 	origin := r.Header.Get("Origin")
 	if origin == "" {
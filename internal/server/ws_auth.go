@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+// Close codes sent to WebSocket clients whose credentials stop being valid,
+// or that fall behind under the disconnect backpressure policy.
+const (
+	wsCloseTokenExpired = 4001
+	wsCloseRevoked      = 4002
+	wsCloseForbidden    = 4003
+	wsCloseLagged       = 4004
+)
+
+const wsActionAuth = "auth"
+
+// WSClientFrame is a message sent by the client over the socket.
+type WSClientFrame struct {
+	Action string   `json:"action"`
+	Token  string   `json:"token,omitempty"`
+	Topic  string   `json:"topic,omitempty"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+func wsAck(action string, data gin.H) WSMessage {
+	if data == nil {
+		data = gin.H{}
+	}
+	data["action"] = action
+	return NewWSMessage("ack", data)
+}
+
+func wsError(action, message string) WSMessage {
+	return NewWSMessage("error", gin.H{"action": action, "error": message})
+}
+
+func (c *Client) handleFrame(frame WSClientFrame) {
+	switch frame.Action {
+	case wsActionAuth:
+		c.reauthenticate(frame.Token)
+	case wsActionSubscribe, wsActionUnsubscribe:
+		c.updateSubscriptions(frame)
+	default:
+		c.reply(wsError(frame.Action, "unknown action"))
+	}
+}
+
+// reauthenticate swaps in a fresh access token of the same session so the
+// connection outlives the token it was opened with.
+func (c *Client) reauthenticate(token string) {
+	current := c.authContext()
+	if current.APIKeyID != 0 {
+		c.reply(wsError(wsActionAuth, "api key connections cannot re-authenticate"))
+		return
+	}
+
+	auth, _, err := c.srv.authenticateToken(token)
+	if err != nil {
+		c.reply(wsError(wsActionAuth, err.Error()))
+		return
+	}
+	if auth.UserID != current.UserID || auth.SessionID != current.SessionID {
+		c.reply(wsError(wsActionAuth, "token belongs to another session"))
+		return
+	}
+	if !auth.Can(models.PermWSSubscribe) {
+		c.reply(wsError(wsActionAuth, "forbidden"))
+		return
+	}
+
+	c.setAuth(auth)
+	c.reply(wsAck(wsActionAuth, gin.H{"expires_at": auth.ExpiresAt}))
+}
+
+// revalidateClient re-checks a connected client against the database and
+// returns a close code when it must be dropped. Role changes apply here, so a
+// demoted user loses the socket within a ping period. Transient errors keep
+// the connection.
+func (s *Server) revalidateClient(c *Client) (int, string) {
+	auth := c.authContext()
+
+	if auth.APIKeyID != 0 {
+		fresh, err := s.apiKeyAuth(context.Background(), "id = ?", auth.APIKeyID)
+		if err != nil {
+			if errors.Is(err, errInvalidAPIKey) {
+				return wsCloseRevoked, "api key revoked"
+			}
+			return 0, ""
+		}
+		if !fresh.Can(models.PermWSSubscribe) {
+			return wsCloseForbidden, "forbidden"
+		}
+		c.setAuth(fresh)
+		return 0, ""
+	}
+
+	if err := s.sessions.check(auth.SessionID, auth.UserID); err != nil {
+		if errors.Is(err, errSessionRevoked) {
+			return wsCloseRevoked, "session revoked"
+		}
+		return 0, ""
+	}
+
+	var user models.User
+	if err := s.db.Select("id", "role", "disabled_at").First(&user, auth.UserID).Error; err != nil {
+		if errorsIs(err, gorm.ErrRecordNotFound) {
+			return wsCloseRevoked, "session revoked"
+		}
+		return 0, ""
+	}
+	if user.DisabledAt != nil {
+		return wsCloseRevoked, "session revoked"
+	}
+
+	perms, err := s.permissions.forRole(user.Role)
+	if err != nil {
+		return 0, ""
+	}
+	if !perms.has(models.PermWSSubscribe) {
+		return wsCloseForbidden, "forbidden"
+	}
+
+	updated := *auth
+	updated.Role = user.Role
+	updated.Permissions = perms
+	c.setAuth(&updated)
+	return 0, ""
+}
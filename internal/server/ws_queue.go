@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Backpressure policies: what a client's queue does with a new message when
+// it is full because the client reads slower than events arrive.
+const (
+	// backpressureDropOldest discards the oldest queued message.
+	backpressureDropOldest = "drop_oldest"
+	// backpressureCoalesce replaces the queued message about the same product
+	// or category, so only its latest state is sent; messages without an
+	// entity fall back to dropping the oldest.
+	backpressureCoalesce = "coalesce"
+	// backpressureDisconnect closes the connection with wsCloseLagged.
+	backpressureDisconnect = "disconnect"
+)
+
+func validBackpressure(policy string) bool {
+	switch policy {
+	case backpressureDropOldest, backpressureCoalesce, backpressureDisconnect:
+		return true
+	}
+	return false
+}
+
+// pushResult tells the hub what happened to a message, for its counters.
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushDroppedOldest
+	pushCoalesced
+	pushDisconnected
+	pushClosed
+)
+
+// sendQueue is a client's bounded outgoing queue. push never blocks, so a
+// slow client cannot hold up the hub; what happens when it is full depends on
+// the policy. Only writePump takes from it.
+type sendQueue struct {
+	mu     sync.Mutex
+	items  []WSMessage
+	limit  int
+	policy string
+	// dropped counts messages lost since the last take, reported to the
+	// client as a lagged notice.
+	dropped   int
+	closed    bool
+	closeCode int
+	closeText string
+	ready     chan struct{}
+}
+
+func newSendQueue(limit int, policy string) *sendQueue {
+	if limit < 1 {
+		limit = 1
+	}
+	return &sendQueue{limit: limit, policy: policy, ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) push(msg WSMessage) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return pushClosed
+	}
+	defer q.signal()
+
+	if len(q.items) < q.limit {
+		q.items = append(q.items, msg)
+		return pushQueued
+	}
+
+	switch q.policy {
+	case backpressureDisconnect:
+		q.items = nil
+		q.closed = true
+		q.closeCode, q.closeText = wsCloseLagged, "client too slow"
+		return pushDisconnected
+	case backpressureCoalesce:
+		if key := entityTopic(msg); key != "" {
+			for i := len(q.items) - 1; i >= 0; i-- {
+				if entityTopic(q.items[i]) == key {
+					// Move it to the back so sequence numbers stay in order.
+					q.items = append(q.items[:i], q.items[i+1:]...)
+					q.items = append(q.items, msg)
+					q.dropped++
+					return pushCoalesced
+				}
+			}
+		}
+	}
+
+	q.items = append(q.items[1:], msg)
+	q.dropped++
+	return pushDroppedOldest
+}
+
+// close stops the queue; writePump sends what is left and then the close
+// frame. It reports false when the queue was already closed.
+func (q *sendQueue) close(code int, text string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.closed = true
+	q.closeCode, q.closeText = code, text
+	q.signal()
+	return true
+}
+
+type queueBatch struct {
+	items     []WSMessage
+	dropped   int
+	closed    bool
+	closeCode int
+	closeText string
+}
+
+func (q *sendQueue) take() queueBatch {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch := queueBatch{
+		items:     q.items,
+		dropped:   q.dropped,
+		closed:    q.closed,
+		closeCode: q.closeCode,
+		closeText: q.closeText,
+	}
+	q.items, q.dropped = nil, 0
+	return batch
+}
+
+// entityTopic is the product:N or category:N topic of a message, the key
+// coalescing groups by.
+func entityTopic(msg WSMessage) string {
+	for _, topic := range msg.Topics {
+		if resourceTopicPattern.MatchString(topic) {
+			return topic
+		}
+	}
+	return ""
+}
+
+func laggedMessage(dropped int, policy string) WSMessage {
+	return NewWSMessage("lagged", gin.H{
+		"dropped": dropped,
+		"policy":  policy,
+		"error":   fmt.Sprintf("%d events were not delivered because the connection could not keep up", dropped),
+	})
+}
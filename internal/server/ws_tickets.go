@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/models"
+)
+
+const wsTicketTTL = 30 * time.Second
+
+var errInvalidWSTicket = errors.New("invalid or expired ticket")
+
+func (s *Server) issueWSTicket(c *gin.Context) {
+	raw, err := randomToken(32)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to issue ticket")
+		return
+	}
+
+	auth := getAuthContext(c)
+	now := time.Now()
+	ticket := models.WSTicket{
+		TokenHash:      hashToken(raw),
+		UserID:         auth.UserID,
+		APIKeyID:       auth.APIKeyID,
+		OrganizationID: auth.OrgID,
+		SessionID:      auth.SessionID,
+		Role:           auth.Role,
+		AuthExpiresAt:  auth.ExpiresAt,
+		ExpiresAt:      now.Add(wsTicketTTL),
+	}
+	if err := s.dbFor(c).Create(&ticket).Error; err != nil {
+		respondError(c, http.StatusInternalServerError, "failed to issue ticket")
+		return
+	}
+
+	// Unredeemed tickets are swept here rather than by a background job.
+	_ = s.dbFor(c).Where("expires_at < ?", now).Delete(&models.WSTicket{}).Error
+
+	c.JSON(http.StatusCreated, gin.H{
+		"ticket":     raw,
+		"expires_in": int(wsTicketTTL.Seconds()),
+	})
+}
+
+// wsAuthMiddleware accepts a ticket from POST /api/ws/ticket in ?ticket=;
+// clients that can set headers may still send a bearer JWT or an API key.
+func (s *Server) wsAuthMiddleware() gin.HandlerFunc {
+	byHeader := s.authMiddleware(models.PermWSSubscribe)
+
+	return func(c *gin.Context) {
+		raw := c.Query("ticket")
+		if raw == "" {
+			byHeader(c)
+			return
+		}
+
+		auth, status, err := s.redeemWSTicket(c.Request.Context(), raw)
+		if err != nil {
+			respondError(c, status, err.Error())
+			c.Abort()
+			return
+		}
+		if !auth.Can(models.PermWSSubscribe) {
+			respondError(c, http.StatusForbidden, "forbidden")
+			c.Abort()
+			return
+		}
+
+		c.Set(userContextKey, auth)
+		c.Next()
+	}
+}
+
+// redeemWSTicket deletes the ticket as it reads it, so it works only once
+// even across replicas.
+func (s *Server) redeemWSTicket(ctx context.Context, raw string) (*AuthContext, int, error) {
+	var ticket models.WSTicket
+	res := s.db.WithContext(ctx).Clauses(clause.Returning{}).
+		Where("token_hash = ? AND expires_at > ?", hashToken(raw), time.Now()).
+		Delete(&ticket)
+	if res.Error != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed to verify ticket")
+	}
+	if res.RowsAffected == 0 {
+		return nil, http.StatusUnauthorized, errInvalidWSTicket
+	}
+
+	if ticket.APIKeyID != 0 {
+		auth, err := s.apiKeyAuth(ctx, "id = ?", ticket.APIKeyID)
+		if err != nil {
+			if errors.Is(err, errInvalidAPIKey) {
+				return nil, http.StatusUnauthorized, err
+			}
+			return nil, http.StatusInternalServerError, errors.New("failed to verify api key")
+		}
+		return auth, 0, nil
+	}
+
+	if err := s.sessions.check(ticket.SessionID, ticket.UserID); err != nil {
+		if errors.Is(err, errSessionRevoked) {
+			return nil, http.StatusUnauthorized, err
+		}
+		return nil, http.StatusInternalServerError, errors.New("failed to verify session")
+	}
+
+	perms, err := s.permissions.forRole(ticket.Role)
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed to load permissions")
+	}
+
+	return &AuthContext{
+		UserID:      ticket.UserID,
+		Role:        ticket.Role,
+		OrgID:       ticket.OrganizationID,
+		SessionID:   ticket.SessionID,
+		ExpiresAt:   ticket.AuthExpiresAt,
+		Permissions: perms,
+	}, 0, nil
+}
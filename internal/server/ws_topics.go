@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	topicProducts   = "products.*"
+	topicCategories = "categories.*"
+	topicStockLow   = "stock.low"
+
+	maxSubscriptions = 100
+)
+
+const (
+	wsActionSubscribe   = "subscribe"
+	wsActionUnsubscribe = "unsubscribe"
+)
+
+var resourceTopicPattern = regexp.MustCompile(`^(product|category):[1-9][0-9]*$`)
+
+// defaultTopics keep clients that never subscribe receiving every catalog
+// event, as before topics existed.
+var defaultTopics = []string{topicProducts, topicCategories}
+
+func validTopic(topic string) bool {
+	switch topic {
+	case topicProducts, topicCategories, topicStockLow:
+		return true
+	}
+	return resourceTopicPattern.MatchString(topic)
+}
+
+func productMessage(event string, id uint, data interface{}) WSMessage {
+	return WSMessage{Event: event, Data: data, Topics: []string{topicProducts, fmt.Sprintf("product:%d", id)}}
+}
+
+func categoryMessage(event string, id uint, data interface{}) WSMessage {
+	return WSMessage{Event: event, Data: data, Topics: []string{topicCategories, fmt.Sprintf("category:%d", id)}}
+}
+
+// stockLowMessage is sent when a product's stock reaches the threshold from
+// above (or is created at or below it).
+func stockLowMessage(product interface{}) WSMessage {
+	return WSMessage{Event: topicStockLow, Data: product, Topics: []string{topicStockLow}}
+}
+
+func (s *Server) crossedLowStock(before, after int, created bool) bool {
+	threshold := s.cfg.LowStockThreshold
+	return after <= threshold && (created || before > threshold)
+}
+
+// parseTopics reads the ?topics= CSV of a connection; without it the client
+// gets defaultTopics.
+func parseTopics(raw string, present bool) ([]string, error) {
+	if !present {
+		return defaultTopics, nil
+	}
+
+	var topics []string
+	for _, topic := range strings.Split(raw, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" {
+			continue
+		}
+		if !validTopic(topic) {
+			return nil, fmt.Errorf("invalid topic %q", topic)
+		}
+		topics = append(topics, topic)
+	}
+	if len(topics) > maxSubscriptions {
+		return nil, fmt.Errorf("at most %d topics", maxSubscriptions)
+	}
+	return topics, nil
+}
+
+func (c *Client) subscribedToAny(topics []string) bool {
+	if len(topics) == 0 {
+		return true
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, topic := range topics {
+		if _, ok := c.topics[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) topicList() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		out = append(out, topic)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (c *Client) updateSubscriptions(frame WSClientFrame) {
+	topics := frame.Topics
+	if frame.Topic != "" {
+		topics = append(topics, frame.Topic)
+	}
+	if len(topics) == 0 {
+		c.reply(wsError(frame.Action, "topic is required"))
+		return
+	}
+	for _, topic := range topics {
+		if !validTopic(topic) {
+			c.reply(wsError(frame.Action, fmt.Sprintf("invalid topic %q", topic)))
+			return
+		}
+	}
+
+	c.mu.Lock()
+	if frame.Action == wsActionSubscribe {
+		added := make(map[string]struct{}, len(topics))
+		for _, topic := range topics {
+			if _, ok := c.topics[topic]; !ok {
+				added[topic] = struct{}{}
+			}
+		}
+		if len(c.topics)+len(added) > maxSubscriptions {
+			c.mu.Unlock()
+			c.reply(wsError(frame.Action, fmt.Sprintf("at most %d topics", maxSubscriptions)))
+			return
+		}
+		for topic := range added {
+			c.topics[topic] = struct{}{}
+		}
+	} else {
+		for _, topic := range topics {
+			delete(c.topics, topic)
+		}
+	}
+	c.mu.Unlock()
+
+	c.reply(wsAck(frame.Action, gin.H{"topics": c.topicList()}))
+}
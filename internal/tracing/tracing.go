@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ignimbrite/bsmart-challenge/internal/config"
+)
+
+// Propagator carries trace context in W3C traceparent/tracestate headers.
+var Propagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// Setup installs the global tracer provider for OTEL_TRACES_EXPORTER: "otlp"
+// (OTLP over HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout" or "none". The returned function flushes pending spans and must be
+// called on shutdown.
+func Setup(cfg config.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(Propagator)
+
+	var exporter sdktrace.SpanExporter
+	switch strings.ToLower(cfg.TracesExporter) {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	case "stdout", "console":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stderr), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("invalid OTEL_TRACES_EXPORTER %q", cfg.TracesExporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.DeploymentEnvironment(cfg.AppEnv),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(untracedQueries{sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TracesSampleRatio))}),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// untracedQueries drops database statements that do not belong to a trace,
+// such as the polling of the background workers, which would otherwise
+// each start a trace of their own.
+type untracedQueries struct {
+	sdktrace.Sampler
+}
+
+func (s untracedQueries) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.Kind == trace.SpanKindClient && !trace.SpanContextFromContext(p.ParentContext).IsValid() {
+		return sdktrace.SamplingResult{Decision: sdktrace.Drop}
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+func (s untracedQueries) Description() string {
+	return "UntracedQueries{" + s.Sampler.Description() + "}"
+}
+
+// Inject returns the traceparent of the span in ctx, or "" if there is none.
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Extract returns ctx with the remote span described by traceparent.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return Propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
@@ -0,0 +1,21 @@
+DROP TABLE IF EXISTS "webhook_deliveries";
+DROP TABLE IF EXISTS "webhooks";
+DROP TABLE IF EXISTS "outbox_events";
+DROP TABLE IF EXISTS "events";
+DROP TABLE IF EXISTS "ws_tickets";
+DROP TABLE IF EXISTS "user_tokens";
+DROP TABLE IF EXISTS "sessions";
+DROP TABLE IF EXISTS "refresh_tokens";
+DROP TABLE IF EXISTS "recovery_codes";
+DROP TABLE IF EXISTS "api_key_permissions";
+DROP TABLE IF EXISTS "api_keys";
+DROP TABLE IF EXISTS "permissions";
+DROP TABLE IF EXISTS "role_permissions";
+DROP TABLE IF EXISTS "roles";
+DROP TABLE IF EXISTS "users";
+DROP TABLE IF EXISTS "product_histories";
+DROP TABLE IF EXISTS "products";
+DROP TABLE IF EXISTS "product_categories";
+DROP TABLE IF EXISTS "categories";
+DROP TABLE IF EXISTS "memberships";
+DROP TABLE IF EXISTS "organizations";
@@ -0,0 +1,283 @@
+-- The schema AutoMigrate built from the models when versioned migrations were
+-- introduced. Databases created by AutoMigrate are adopted at this version.
+
+CREATE TABLE "organizations" (
+    "id" bigserial,
+    "name" varchar(255) NOT NULL,
+    "slug" varchar(100) NOT NULL,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_organizations_slug" ON "organizations" ("slug");
+
+CREATE TABLE "memberships" (
+    "organization_id" bigint,
+    "user_id" bigint,
+    "created_at" timestamptz,
+    PRIMARY KEY ("organization_id","user_id")
+);
+CREATE INDEX "idx_memberships_user_id" ON "memberships" ("user_id");
+
+CREATE TABLE "categories" (
+    "id" bigserial,
+    "organization_id" bigint NOT NULL,
+    "name" varchar(255) NOT NULL,
+    "description" text,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_categories_created_at" ON "categories" ("created_at");
+CREATE UNIQUE INDEX "idx_categories_org_name" ON "categories" ("organization_id","name");
+
+CREATE TABLE "product_categories" (
+    "product_id" bigint,
+    "category_id" bigint,
+    PRIMARY KEY ("product_id","category_id")
+);
+
+CREATE TABLE "products" (
+    "id" bigserial,
+    "organization_id" bigint NOT NULL,
+    "name" varchar(255) NOT NULL,
+    "description" text,
+    "price" numeric(12,2) NOT NULL,
+    "stock" bigint NOT NULL DEFAULT 0,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_products_created_at" ON "products" ("created_at");
+CREATE INDEX "idx_products_stock" ON "products" ("stock");
+CREATE INDEX "idx_products_name" ON "products" ("name" asc);
+CREATE INDEX "idx_products_organization_id" ON "products" ("organization_id");
+
+CREATE TABLE "product_histories" (
+    "id" bigserial,
+    "product_id" bigint NOT NULL,
+    "price" numeric(12,2) NOT NULL,
+    "stock" bigint NOT NULL,
+    "changed_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_products_history" FOREIGN KEY ("product_id") REFERENCES "products"("id") ON DELETE CASCADE
+);
+CREATE INDEX "idx_product_histories_product_id" ON "product_histories" ("product_id");
+
+CREATE TABLE "users" (
+    "id" bigserial,
+    "email" varchar(255) NOT NULL,
+    "password_hash" text NOT NULL,
+    "role" varchar(50) NOT NULL,
+    "disabled_at" timestamptz,
+    "failed_logins" bigint NOT NULL DEFAULT 0,
+    "locked_until" timestamptz,
+    "totp_secret" varchar(64),
+    "totp_enabled_at" timestamptz,
+    "totp_last_step" bigint NOT NULL DEFAULT 0,
+    "o_id_c_subject" varchar(255),
+    "email_verified_at" timestamptz,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_users_o_id_c_subject" ON "users" ("o_id_c_subject");
+CREATE INDEX "idx_users_disabled_at" ON "users" ("disabled_at");
+CREATE INDEX "idx_users_role" ON "users" ("role");
+CREATE UNIQUE INDEX "idx_users_email" ON "users" ("email");
+
+CREATE TABLE "roles" (
+    "id" bigserial,
+    "name" varchar(50) NOT NULL,
+    "description" text,
+    "system" boolean NOT NULL DEFAULT false,
+    "require_mfa" boolean NOT NULL DEFAULT false,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_roles_name" ON "roles" ("name");
+
+CREATE TABLE "role_permissions" (
+    "role_id" bigint,
+    "permission_id" bigint,
+    PRIMARY KEY ("role_id","permission_id")
+);
+
+CREATE TABLE "permissions" (
+    "id" bigserial,
+    "name" varchar(100) NOT NULL,
+    "description" text,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_permissions_name" ON "permissions" ("name");
+
+CREATE TABLE "api_keys" (
+    "id" bigserial,
+    "organization_id" bigint NOT NULL,
+    "name" varchar(255) NOT NULL,
+    "prefix" varchar(16) NOT NULL,
+    "key_hash" varchar(64) NOT NULL,
+    "created_by_id" bigint NOT NULL,
+    "expires_at" timestamptz NOT NULL,
+    "last_used_at" timestamptz,
+    "revoked_at" timestamptz,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_api_keys_revoked_at" ON "api_keys" ("revoked_at");
+CREATE INDEX "idx_api_keys_created_by_id" ON "api_keys" ("created_by_id");
+CREATE UNIQUE INDEX "idx_api_keys_key_hash" ON "api_keys" ("key_hash");
+CREATE INDEX "idx_api_keys_organization_id" ON "api_keys" ("organization_id");
+
+CREATE TABLE "api_key_permissions" (
+    "api_key_id" bigint,
+    "permission_id" bigint,
+    PRIMARY KEY ("api_key_id","permission_id")
+);
+
+CREATE TABLE "recovery_codes" (
+    "id" bigserial,
+    "user_id" bigint NOT NULL,
+    "code_hash" varchar(64) NOT NULL,
+    "used_at" timestamptz,
+    "created_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_recovery_codes_code_hash" ON "recovery_codes" ("code_hash");
+CREATE INDEX "idx_recovery_codes_user_id" ON "recovery_codes" ("user_id");
+
+CREATE TABLE "refresh_tokens" (
+    "id" bigserial,
+    "user_id" bigint NOT NULL,
+    "organization_id" bigint NOT NULL,
+    "family_id" varchar(64) NOT NULL,
+    "token_hash" varchar(64) NOT NULL,
+    "expires_at" timestamptz NOT NULL,
+    "revoked_at" timestamptz,
+    "replaced_by_id" bigint,
+    "created_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_refresh_tokens_revoked_at" ON "refresh_tokens" ("revoked_at");
+CREATE INDEX "idx_refresh_tokens_expires_at" ON "refresh_tokens" ("expires_at");
+CREATE UNIQUE INDEX "idx_refresh_tokens_token_hash" ON "refresh_tokens" ("token_hash");
+CREATE INDEX "idx_refresh_tokens_family_id" ON "refresh_tokens" ("family_id");
+CREATE INDEX "idx_refresh_tokens_user_id" ON "refresh_tokens" ("user_id");
+
+CREATE TABLE "sessions" (
+    "id" varchar(32),
+    "user_id" bigint NOT NULL,
+    "organization_id" bigint NOT NULL,
+    "user_agent" varchar(255),
+    "ip" varchar(64),
+    "expires_at" timestamptz NOT NULL,
+    "last_seen_at" timestamptz NOT NULL,
+    "revoked_at" timestamptz,
+    "created_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_sessions_revoked_at" ON "sessions" ("revoked_at");
+CREATE INDEX "idx_sessions_user_id" ON "sessions" ("user_id");
+
+CREATE TABLE "user_tokens" (
+    "id" bigserial,
+    "user_id" bigint NOT NULL,
+    "purpose" varchar(32) NOT NULL,
+    "token_hash" varchar(64) NOT NULL,
+    "expires_at" timestamptz NOT NULL,
+    "used_at" timestamptz,
+    "created_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE UNIQUE INDEX "idx_user_tokens_token_hash" ON "user_tokens" ("token_hash");
+CREATE INDEX "idx_user_tokens_purpose" ON "user_tokens" ("purpose");
+CREATE INDEX "idx_user_tokens_user_id" ON "user_tokens" ("user_id");
+
+CREATE TABLE "ws_tickets" (
+    "token_hash" varchar(64),
+    "user_id" bigint,
+    "api_key_id" bigint,
+    "organization_id" bigint NOT NULL,
+    "session_id" varchar(32),
+    "role" varchar(50),
+    "auth_expires_at" timestamptz,
+    "expires_at" timestamptz NOT NULL,
+    "created_at" timestamptz,
+    PRIMARY KEY ("token_hash")
+);
+CREATE INDEX "idx_ws_tickets_expires_at" ON "ws_tickets" ("expires_at");
+
+CREATE TABLE "events" (
+    "seq" bigserial,
+    "organization_id" bigint NOT NULL,
+    "type" varchar(64) NOT NULL,
+    "topics" varchar(255) NOT NULL,
+    "payload" jsonb NOT NULL,
+    "request_id" varchar(128),
+    "trace_parent" varchar(64),
+    "created_at" timestamptz NOT NULL,
+    PRIMARY KEY ("seq")
+);
+CREATE INDEX "idx_events_created_at" ON "events" ("created_at");
+CREATE INDEX "idx_events_org_seq" ON "events" ("organization_id","seq");
+
+CREATE TABLE "outbox_events" (
+    "id" bigserial,
+    "organization_id" bigint NOT NULL,
+    "type" varchar(64) NOT NULL,
+    "topics" varchar(255) NOT NULL,
+    "payload" jsonb NOT NULL,
+    "request_id" varchar(128),
+    "trace_parent" varchar(64),
+    "event_seq" bigint,
+    "dispatched_at" timestamptz,
+    "created_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_outbox_events_created_at" ON "outbox_events" ("created_at");
+CREATE INDEX "idx_outbox_events_pending" ON "outbox_events" ("dispatched_at") WHERE dispatched_at IS NULL;
+CREATE INDEX "idx_outbox_events_event_seq" ON "outbox_events" ("event_seq");
+
+CREATE TABLE "webhooks" (
+    "id" bigserial,
+    "organization_id" bigint NOT NULL,
+    "url" varchar(2048) NOT NULL,
+    "events" varchar(1024) NOT NULL,
+    "secret" varchar(128) NOT NULL,
+    "active" boolean NOT NULL,
+    "created_by_id" bigint NOT NULL,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id")
+);
+CREATE INDEX "idx_webhooks_organization_id" ON "webhooks" ("organization_id");
+
+CREATE TABLE "webhook_deliveries" (
+    "id" bigserial,
+    "webhook_id" bigint NOT NULL,
+    "organization_id" bigint NOT NULL,
+    "event_seq" bigint NOT NULL,
+    "event" varchar(64) NOT NULL,
+    "payload" jsonb NOT NULL,
+    "status" varchar(16) NOT NULL,
+    "attempts" bigint NOT NULL DEFAULT 0,
+    "next_attempt_at" timestamptz NOT NULL,
+    "last_attempt_at" timestamptz,
+    "delivered_at" timestamptz,
+    "response_status" bigint,
+    "response_body" text,
+    "last_error" text,
+    "replay_of_id" bigint,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_webhooks_deliveries" FOREIGN KEY ("webhook_id") REFERENCES "webhooks"("id") ON DELETE CASCADE
+);
+CREATE INDEX "idx_webhook_deliveries_created_at" ON "webhook_deliveries" ("created_at");
+CREATE INDEX "idx_webhook_deliveries_due" ON "webhook_deliveries" ("status","next_attempt_at");
+CREATE INDEX "idx_webhook_deliveries_webhook_id" ON "webhook_deliveries" ("webhook_id");
+
+-- The organization the seed data goes into.
+INSERT INTO "organizations" ("name", "slug", "created_at", "updated_at") VALUES ('Default', 'default', NOW(), NOW());
@@ -0,0 +1,3 @@
+-- Receivers' answers are no longer kept: showing them let a webhook read
+-- whatever the URL it points at returns.
+ALTER TABLE "webhook_deliveries" DROP COLUMN IF EXISTS "response_body";
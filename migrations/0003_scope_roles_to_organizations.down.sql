@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "idx_roles_organization_id";
+ALTER TABLE "roles" DROP COLUMN IF EXISTS "organization_id";
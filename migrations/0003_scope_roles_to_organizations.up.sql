@@ -0,0 +1,5 @@
+-- Custom roles belong to the organization that created them. Roles without
+-- one (the built-in roles and those created before) are shared by every
+-- organization and only platform admins change them.
+ALTER TABLE "roles" ADD COLUMN IF NOT EXISTS "organization_id" bigint;
+CREATE INDEX IF NOT EXISTS "idx_roles_organization_id" ON "roles" ("organization_id");
@@ -0,0 +1,9 @@
+// Package migrations holds the versioned SQL migrations, embedded in the
+// binary. Files are named <version>_<name>.up.sql and <version>_<name>.down.sql;
+// create them with `server migrate create <name>`.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS